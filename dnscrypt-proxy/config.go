@@ -1,16 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -74,6 +78,7 @@ type Config struct {
 	SourceDoH                bool                        `toml:"doh_servers"`
 	SourceIPv4               bool                        `toml:"ipv4_servers"`
 	SourceIPv6               bool                        `toml:"ipv6_servers"`
+	SourcesMaxBandwidth      int64                       `toml:"sources_max_bandwidth"`
 	MaxClients               uint32                      `toml:"max_clients"`
 	FallbackResolver         string                      `toml:"fallback_resolver"`
 	FallbackResolvers        []string                    `toml:"fallback_resolvers"`
@@ -143,13 +148,147 @@ type StaticConfig struct {
 }
 
 type SourceConfig struct {
-	URL            string
-	URLs           []string
-	MinisignKeyStr string `toml:"minisign_key"`
-	CacheFile      string `toml:"cache_file"`
-	FormatStr      string `toml:"format"`
-	RefreshDelay   int    `toml:"refresh_delay"`
-	Prefix         string
+	URL                   string
+	URLs                  []string
+	MinisignKeyStr        string   `toml:"minisign_key"`
+	MinisignKeyStrs       []string `toml:"minisign_keys"`
+	CacheFile             string   `toml:"cache_file"`
+	FormatStr             string   `toml:"format"`
+	RefreshDelay          int      `toml:"refresh_delay"`
+	Prefix                string
+	MaxServers            int  `toml:"max_servers"`
+	MaxServersReject      bool `toml:"max_servers_reject"`
+	Archive               bool
+	MinDownloadSize       *int   `toml:"min_download_size"`
+	BreakerThreshold      int    `toml:"breaker_threshold"`
+	BreakerCooldown       int    `toml:"breaker_cooldown"`
+	TLSMinVersion         string `toml:"tls_min_version"`
+	TLSCAFile             string `toml:"tls_ca_file"`
+	SignatureFallbackPath string `toml:"signature_fallback_path"`
+	PinKeys               bool   `toml:"pin_keys"`
+	AcceptKeyChange       bool   `toml:"accept_key_change"`
+	Bundle                bool
+	ExpandEnv             bool     `toml:"expand_env"`
+	SignatureAfterQuery   bool     `toml:"signature_after_query"`
+	PreferNewest          bool     `toml:"prefer_newest"`
+	NameNormalization     string   `toml:"name_normalization"`
+	HostNormalization     string   `toml:"host_normalization"`
+	ReuseCachedSignature  bool     `toml:"reuse_cached_signature"`
+	CommentPrefixes       []string `toml:"comment_prefixes"`
+	SignatureSuffix       string   `toml:"signature_suffix"`
+	OnParseFailure        string   `toml:"on_parse_failure"`
+	IncludeServers        []string `toml:"include_servers"`
+	ExcludeServers        []string `toml:"exclude_servers"`
+	SignatureURLs         []string `toml:"signature_urls"`
+	DisableKeepAlives     bool     `toml:"disable_keepalives"`
+	VerifyCacheSize       int      `toml:"verify_cache_size"`
+	Offline               bool     `toml:"offline"`
+	DefaultFilename       string   `toml:"default_filename"`
+	HonorCacheControl     bool     `toml:"honor_cache_control"`
+	MirrorWeights         []int    `toml:"mirror_weights"`
+	Role                  string   `toml:"role"`
+	RefreshBudget         int      `toml:"refresh_budget"`
+	KeyManifestURL        string   `toml:"key_manifest_url"`
+	SignatureFirst        bool     `toml:"signature_first"`
+	CheckUTF8             bool     `toml:"check_utf8"`
+	Tags                  []string `toml:"tags"`
+	TimestampPolicy       string   `toml:"timestamp_policy"`
+	HTTPVersion           string   `toml:"http_version"`
+	SignatureDelay        int      `toml:"signature_delay"`
+	SeedFile              string   `toml:"seed_file"`
+	ChecksumManifest      bool     `toml:"checksum_manifest"`
+	NoCacheSignature      bool     `toml:"no_cache_signature"`
+	AcceptFormats         []string `toml:"accept_formats"`
+	SafeReload            bool     `toml:"safe_reload"`
+	MinServers            int      `toml:"min_servers"`
+	AcceptedStatusCodes   []int    `toml:"accepted_status_codes"`
+	MaxBandwidth          int64    `toml:"max_bandwidth"`
+	OverrideFile          string   `toml:"override_file"`
+	OverrideUnsigned      bool     `toml:"override_unsigned"`
+	OverrideKeys          []string `toml:"override_minisign_keys"`
+	PinnedHash            string   `toml:"pinned_hash"`
+	ContentMarker         string   `toml:"content_marker"`
+	ContentMarkerFold     bool     `toml:"content_marker_fold"`
+	RefreshAt             string   `toml:"refresh_at"`
+	Resolvers             []string `toml:"resolvers"`
+	Tenant                string   `toml:"tenant"`
+	DedupNames            bool     `toml:"dedup_names"`
+	DedupStamps           bool     `toml:"dedup_stamps"`
+	FreshnessJitter       int      `toml:"freshness_jitter"`
+	InstanceID            string   `toml:"instance_id"`
+	Timeout               int      `toml:"timeout"`
+	TimeoutThroughput     int64    `toml:"timeout_throughput"`
+	Name                  string   `toml:"-"` // set from the name of the [sources] table
+	// validity periods of keys, by key ID
+	KeyValidity map[string]KeyValidityConfig `toml:"key_validity"`
+}
+
+// KeyValidityConfig is the validity period of a key, as RFC 3339 times or dates
+type KeyValidityConfig struct {
+	NotBefore string `toml:"not_before"`
+	NotAfter  string `toml:"not_after"`
+}
+
+func parseKeyValidityTime(str string) (time.Time, error) {
+	if len(str) == 0 {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", str); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, str)
+}
+
+func (cfgSource *SourceConfig) keyValidity() (map[string]KeyValidity, error) {
+	if len(cfgSource.KeyValidity) == 0 {
+		return nil, nil
+	}
+	keyValidity := make(map[string]KeyValidity, len(cfgSource.KeyValidity))
+	for keyID, cfgValidity := range cfgSource.KeyValidity {
+		var validity KeyValidity
+		var err error
+		if validity.NotBefore, err = parseKeyValidityTime(cfgValidity.NotBefore); err != nil {
+			return nil, fmt.Errorf("Invalid validity period of key [%s]: %v", keyID, err)
+		}
+		if validity.NotAfter, err = parseKeyValidityTime(cfgValidity.NotAfter); err != nil {
+			return nil, fmt.Errorf("Invalid validity period of key [%s]: %v", keyID, err)
+		}
+		keyValidity[strings.ToUpper(keyID)] = validity
+	}
+	return keyValidity, nil
+}
+
+func (cfgSource *SourceConfig) minisignKeyStrs() []string {
+	minisignKeyStrs := cfgSource.MinisignKeyStrs
+	if cfgSource.MinisignKeyStr != "" {
+		minisignKeyStrs = append([]string{cfgSource.MinisignKeyStr}, minisignKeyStrs...)
+	}
+	return minisignKeyStrs
+}
+
+// cacheKeyOptions returns the options of the source deriving its cache file, to compare it with the others before loading them
+func (cfgSource *SourceConfig) cacheKeyOptions() SourceOptions {
+	if len(cfgSource.Tenant) == 0 {
+		return SourceOptions{ExpandEnv: cfgSource.ExpandEnv}
+	}
+	return SourceOptions{ExpandEnv: cfgSource.ExpandEnv, Tenant: cfgSource.Tenant, CacheKey: TenantCacheKey}
+}
+
+// ValidateKeys decodes the Minisign keys of all the sources, without any network activity, reporting every invalid key at once
+func ValidateKeys(cfgSources []SourceConfig) (errs []error) {
+	for _, cfgSource := range cfgSources {
+		for _, minisignKeyStr := range cfgSource.minisignKeyStrs() {
+			if _, err := parseSourceKey(minisignKeyStr); err != nil {
+				errs = append(errs, fmt.Errorf("Invalid Minisign key for source [%s]: %v", cfgSource.Name, err))
+			}
+		}
+		for _, overrideKeyStr := range cfgSource.OverrideKeys {
+			if _, err := parseSourceKey(overrideKeyStr); err != nil {
+				errs = append(errs, fmt.Errorf("Invalid Minisign key for the overrides of source [%s]: %v", cfgSource.Name, err))
+			}
+		}
+	}
+	return
 }
 
 type QueryLogConfig struct {
@@ -561,15 +700,16 @@ func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool) {
 		if len(addrStr) > 0 {
 			addrs = append(addrs, hostAddr)
 		}
+		descriptor := registeredServer.Descriptor()
 		serverSummary := ServerSummary{
 			Name:        registeredServer.name,
 			Proto:       registeredServer.stamp.Proto.String(),
 			IPv6:        strings.HasPrefix(addrStr, "["),
 			Ports:       []int{port},
 			Addrs:       addrs,
-			DNSSEC:      registeredServer.stamp.Props&stamps.ServerInformalPropertyDNSSEC != 0,
-			NoLog:       registeredServer.stamp.Props&stamps.ServerInformalPropertyNoLog != 0,
-			NoFilter:    registeredServer.stamp.Props&stamps.ServerInformalPropertyNoFilter != 0,
+			DNSSEC:      descriptor.DNSSEC,
+			NoLog:       descriptor.NoLog,
+			NoFilter:    descriptor.NoFilter,
 			Description: registeredServer.description,
 			Stamp:       registeredServer.stamp.String(),
 		}
@@ -599,8 +739,34 @@ func (config *Config) loadSources(proxy *Proxy) error {
 	if config.SourceRequireNoFilter {
 		requiredProps |= stamps.ServerInformalPropertyNoFilter
 	}
+	cfgSources := make([]SourceConfig, 0, len(config.SourcesConfig))
+	for cfgSourceName, cfgSource := range config.SourcesConfig {
+		cfgSource.Name = cfgSourceName
+		cfgSources = append(cfgSources, cfgSource)
+	}
+	sort.Slice(cfgSources, func(i, j int) bool { return cfgSources[i].Name < cfgSources[j].Name })
+	if errs := ValidateKeys(cfgSources); len(errs) > 0 {
+		for _, err := range errs {
+			dlog.Error(err)
+		}
+		return fmt.Errorf("Invalid Minisign keys in the sources configuration")
+	}
+	cacheFileDefs := make([]SourceDefinition, len(cfgSources))
+	for i, cfgSource := range cfgSources {
+		cacheFileDefs[i] = SourceDefinition{Name: cfgSource.Name, CacheFile: cfgSource.CacheFile, MinisignKeys: cfgSource.minisignKeyStrs(), Options: cfgSource.cacheKeyOptions()}
+	}
+	cacheFileErrs := ValidateCacheFiles(cacheFileDefs)
+	for _, cfgSource := range cfgSources {
+		if err, ok := cacheFileErrs[cfgSource.Name]; ok {
+			return err
+		}
+	}
+	var sharedBandwidth *BandwidthLimiter
+	if config.SourcesMaxBandwidth > 0 {
+		sharedBandwidth = NewBandwidthLimiter(config.SourcesMaxBandwidth * 1024)
+	}
 	for cfgSourceName, cfgSource := range config.SourcesConfig {
-		if err := config.loadSource(proxy, requiredProps, cfgSourceName, &cfgSource); err != nil {
+		if err := config.loadSource(proxy, requiredProps, cfgSourceName, &cfgSource, sharedBandwidth); err != nil {
 			return err
 		}
 	}
@@ -630,7 +796,7 @@ func (config *Config) loadSources(proxy *Proxy) error {
 	return nil
 }
 
-func (config *Config) loadSource(proxy *Proxy, requiredProps stamps.ServerInformalProperties, cfgSourceName string, cfgSource *SourceConfig) error {
+func (config *Config) loadSource(proxy *Proxy, requiredProps stamps.ServerInformalProperties, cfgSourceName string, cfgSource *SourceConfig, sharedBandwidth *BandwidthLimiter) error {
 	if len(cfgSource.URLs) == 0 {
 		if len(cfgSource.URL) == 0 {
 			dlog.Debugf("Missing URLs for source [%s]", cfgSourceName)
@@ -638,7 +804,8 @@ func (config *Config) loadSource(proxy *Proxy, requiredProps stamps.ServerInform
 			cfgSource.URLs = []string{cfgSource.URL}
 		}
 	}
-	if cfgSource.MinisignKeyStr == "" {
+	minisignKeyStrs := cfgSource.minisignKeyStrs()
+	if len(minisignKeyStrs) == 0 && len(cfgSource.KeyManifestURL) == 0 {
 		return fmt.Errorf("Missing Minisign key for source [%s]", cfgSourceName)
 	}
 	if cfgSource.CacheFile == "" {
@@ -650,20 +817,130 @@ func (config *Config) loadSource(proxy *Proxy, requiredProps stamps.ServerInform
 	if cfgSource.RefreshDelay <= 0 {
 		cfgSource.RefreshDelay = 72
 	}
-	source, err := NewSource(cfgSourceName, proxy.xTransport, cfgSource.URLs, cfgSource.MinisignKeyStr, cfgSource.CacheFile, cfgSource.FormatStr, time.Duration(cfgSource.RefreshDelay)*time.Hour)
+	minDownloadSize := DefaultMinDownloadSize
+	if cfgSource.MinDownloadSize != nil {
+		minDownloadSize = *cfgSource.MinDownloadSize
+	}
+	options := SourceOptions{
+		MaxServers:            cfgSource.MaxServers,
+		MaxServersReject:      cfgSource.MaxServersReject,
+		Archive:               cfgSource.Archive,
+		MinDownloadSize:       minDownloadSize,
+		BreakerThreshold:      cfgSource.BreakerThreshold,
+		BreakerCooldown:       time.Duration(cfgSource.BreakerCooldown) * time.Minute,
+		SignatureFallbackPath: cfgSource.SignatureFallbackPath,
+		PinKeys:               cfgSource.PinKeys,
+		AcceptKeyChange:       cfgSource.AcceptKeyChange,
+		Bundle:                cfgSource.Bundle,
+		ExpandEnv:             cfgSource.ExpandEnv,
+		SignatureAfterQuery:   cfgSource.SignatureAfterQuery,
+		PreferNewest:          cfgSource.PreferNewest,
+		ReuseCachedSignature:  cfgSource.ReuseCachedSignature,
+		CommentPrefixes:       cfgSource.CommentPrefixes,
+		SignatureSuffix:       cfgSource.SignatureSuffix,
+		SignatureURLs:         cfgSource.SignatureURLs,
+		DisableKeepAlives:     cfgSource.DisableKeepAlives,
+		VerifyCacheSize:       cfgSource.VerifyCacheSize,
+		Offline:               cfgSource.Offline,
+		DefaultFilename:       cfgSource.DefaultFilename,
+		HonorCacheControl:     cfgSource.HonorCacheControl,
+		MirrorWeights:         cfgSource.MirrorWeights,
+		RefreshBudget:         time.Duration(cfgSource.RefreshBudget) * time.Second,
+		KeyManifestURL:        cfgSource.KeyManifestURL,
+		SignatureFirst:        cfgSource.SignatureFirst,
+		CheckUTF8:             cfgSource.CheckUTF8,
+		Tags:                  cfgSource.Tags,
+		SignatureDelay:        time.Duration(cfgSource.SignatureDelay) * time.Second,
+		SeedFile:              cfgSource.SeedFile,
+		ChecksumManifest:      cfgSource.ChecksumManifest,
+		NoCacheSignature:      cfgSource.NoCacheSignature,
+		AcceptFormats:         cfgSource.AcceptFormats,
+		SafeReload:            cfgSource.SafeReload,
+		MinServers:            cfgSource.MinServers,
+		AcceptedStatusCodes:   cfgSource.AcceptedStatusCodes,
+		MaxBandwidth:          cfgSource.MaxBandwidth * 1024,
+		OverrideFile:          cfgSource.OverrideFile,
+		OverrideUnsigned:      cfgSource.OverrideUnsigned,
+		OverrideKeys:          cfgSource.OverrideKeys,
+		PinnedHash:            cfgSource.PinnedHash,
+		ContentMarker:         cfgSource.ContentMarker,
+		ContentMarkerFold:     cfgSource.ContentMarkerFold,
+		Resolvers:             cfgSource.Resolvers,
+		DedupNames:            cfgSource.DedupNames,
+		DedupStamps:           cfgSource.DedupStamps,
+		FreshnessJitter:       float64(cfgSource.FreshnessJitter) / 100,
+		InstanceID:            cfgSource.InstanceID,
+		Timeout:               time.Duration(cfgSource.Timeout) * time.Second,
+		TimeoutThroughput:     cfgSource.TimeoutThroughput * 1024,
+		SharedBandwidth:       sharedBandwidth,
+	}
+	if len(cfgSource.Tenant) > 0 {
+		options.Tenant, options.CacheKey = cfgSource.Tenant, TenantCacheKey
+	}
+	if err := cfgSource.loadTLSOptions(&options); err != nil {
+		return fmt.Errorf("Source [%s]: %v", cfgSourceName, err)
+	}
+	var err error
+	if options.NameNormalization, err = parseNameNormalization(cfgSource.NameNormalization); err != nil {
+		return fmt.Errorf("Source [%s]: %v", cfgSourceName, err)
+	}
+	if options.HostNormalization, err = parseHostNormalization(cfgSource.HostNormalization); err != nil {
+		return fmt.Errorf("Source [%s]: %v", cfgSourceName, err)
+	}
+	if len(cfgSource.RefreshAt) > 0 {
+		if options.RefreshAt, err = ParseDailySchedule(cfgSource.RefreshAt); err != nil {
+			return fmt.Errorf("Source [%s]: %v", cfgSourceName, err)
+		}
+	}
+	if options.OnParseFailure, err = parseParseFailurePolicy(cfgSource.OnParseFailure); err != nil {
+		return fmt.Errorf("Source [%s]: %v", cfgSourceName, err)
+	}
+	if options.HTTPVersion, err = parseHTTPVersion(cfgSource.HTTPVersion); err != nil {
+		return fmt.Errorf("Source [%s]: %v", cfgSourceName, err)
+	}
+	if options.TimestampPolicy, err = parseTimestampPolicy(cfgSource.TimestampPolicy); err != nil {
+		return fmt.Errorf("Source [%s]: %v", cfgSourceName, err)
+	}
+	if options.Role, err = parseSourceRole(cfgSource.Role); err != nil {
+		return fmt.Errorf("Source [%s]: %v", cfgSourceName, err)
+	}
+	if options.KeyValidity, err = cfgSource.keyValidity(); err != nil {
+		return fmt.Errorf("Source [%s]: %v", cfgSourceName, err)
+	}
+	if options.Filter, err = NewServerFilter(cfgSource.IncludeServers, cfgSource.ExcludeServers); err != nil {
+		return fmt.Errorf("Source [%s]: %v", cfgSourceName, err)
+	}
+	source, err := NewSource(cfgSourceName, proxy.xTransport, cfgSource.URLs, minisignKeyStrs, cfgSource.CacheFile, cfgSource.FormatStr, time.Duration(cfgSource.RefreshDelay)*time.Hour, options)
 	if err != nil {
 		dlog.Criticalf("Unable to retrieve source [%s]: [%s]", cfgSourceName, err)
 		return err
 	}
+	if err := StaleTempCleanup(source.cacheFiles(), StaleTempMinAge); err != nil {
+		dlog.Debugf("Unable to clean up the temporary cache files of source [%s]: %v", cfgSourceName, err)
+	}
 	proxy.sources = append(proxy.sources, source)
-	registeredServers, err := source.Parse(cfgSource.Prefix)
-	if err != nil {
-		if len(registeredServers) == 0 {
+	parsedSources := []*Source{source}
+	if source.options.Archive {
+		if parsedSources, err = source.ArchiveSources(); err != nil {
 			dlog.Criticalf("Unable to use source [%s]: [%s]", cfgSourceName, err)
 			return err
 		}
-		dlog.Warnf("Error in source [%s]: [%s] -- Continuing with reduced server count [%d]", cfgSourceName, err, len(registeredServers))
 	}
+	for _, parsedSource := range parsedSources {
+		registeredServers, err := parsedSource.Parse(cfgSource.Prefix)
+		if err != nil {
+			if len(registeredServers) == 0 {
+				dlog.Criticalf("Unable to use source [%s]: [%s]", parsedSource.name, err)
+				return err
+			}
+			dlog.Warnf("Error in source [%s]: [%s] -- Continuing with reduced server count [%d]", parsedSource.name, err, len(registeredServers))
+		}
+		config.registerServers(proxy, requiredProps, registeredServers)
+	}
+	return nil
+}
+
+func (config *Config) registerServers(proxy *Proxy, requiredProps stamps.ServerInformalProperties, registeredServers []RegisteredServer) {
 	for _, registeredServer := range registeredServers {
 		if registeredServer.stamp.Proto != stamps.StampProtoTypeDNSCryptRelay {
 			if len(config.ServerNames) > 0 {
@@ -701,6 +978,32 @@ func (config *Config) loadSource(proxy *Proxy, requiredProps stamps.ServerInform
 			proxy.registeredServers = append(proxy.registeredServers, registeredServer)
 		}
 	}
+}
+
+func (cfgSource *SourceConfig) loadTLSOptions(options *SourceOptions) error {
+	switch cfgSource.TLSMinVersion {
+	case "":
+	case "1.0":
+		options.TLSMinVersion = tls.VersionTLS10
+	case "1.1":
+		options.TLSMinVersion = tls.VersionTLS11
+	case "1.2":
+		options.TLSMinVersion = tls.VersionTLS12
+	case "1.3":
+		options.TLSMinVersion = tls.VersionTLS13
+	default:
+		return fmt.Errorf("Unsupported TLS version: [%s]", cfgSource.TLSMinVersion)
+	}
+	if len(cfgSource.TLSCAFile) > 0 {
+		pem, err := ioutil.ReadFile(cfgSource.TLSCAFile)
+		if err != nil {
+			return err
+		}
+		options.TLSRootCAs = x509.NewCertPool()
+		if !options.TLSRootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in [%s]", cfgSource.TLSCAFile)
+		}
+	}
 	return nil
 }
 
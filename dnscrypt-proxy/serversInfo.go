@@ -29,6 +29,13 @@ type RegisteredServer struct {
 	name        string
 	stamp       stamps.ServerStamp
 	description string
+	tags        []string
+	descriptor  *ServerDescriptor // only set if the source has DescribeServers
+	role        SourceRole        // role declared by the source the server was loaded from
+	// provider name or address of the stamp as listed by the source, if it was changed by HostNormalization
+	originalHost string
+	// Unicode form of the host name of the stamp, only set with HostNormalizationUnicode, to be displayed instead of the ASCII form dialed
+	displayHost string
 }
 
 type ServerBugs struct {
@@ -2,296 +2,2444 @@
 
 import (
 	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
-	"github.com/dchest/safefile"
-
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/jedisct1/dlog"
 	stamps "github.com/jedisct1/go-dnsstamps"
 	"github.com/jedisct1/go-minisign"
+	"golang.org/x/net/http2"
+	"golang.org/x/text/unicode/norm"
 )
 
 type SourceFormat int
 
 const (
 	SourceFormatV2 = iota
+	SourceFormatYAML
+	SourceFormatJSON
 )
 
+func parseSourceFormat(formatStr string) (SourceFormat, error) {
+	switch formatStr {
+	case "v2":
+		return SourceFormatV2, nil
+	case "yaml":
+		return SourceFormatYAML, nil
+	case "json":
+		return SourceFormatJSON, nil
+	}
+	return SourceFormatV2, fmt.Errorf("Unsupported source format: [%s]", formatStr)
+}
+
 const (
 	DefaultPrefetchDelay    time.Duration = 24 * time.Hour
 	MinimumPrefetchInterval time.Duration = 10 * time.Minute
+	DefaultMinDownloadSize                = 32
+	DefaultBreakerCooldown  time.Duration = 6 * time.Hour
+	DefaultSignatureSuffix                = ".minisig"
+	SignatureRetries                      = 2 // additional attempts to download a signature after a transient error
+	DefaultRefreshBudget    time.Duration = 2 * time.Minute
 )
 
+var (
+	signatureRetries      = SignatureRetries       // replaced during testing
+	signatureRetryBackoff = 500 * time.Millisecond // delay before the first signature download retry, doubled for each one
+)
+
+// SourceOptions holds optional settings of a source; the zero value keeps the default behavior
+type SourceOptions struct {
+	MaxServers       int            // maximum number of servers kept from the source, 0 for no limit
+	MaxServersReject bool           // reject the whole source instead of truncating it when MaxServers is exceeded
+	Archive          bool           // the source is a signed .tar.gz or .zip archive of several sources
+	MinDownloadSize  int            // downloads shorter than this are rejected, not checked if 0 or negative
+	BreakerThreshold int            // consecutive failed verifications before updates are suspended, 0 to never suspend them
+	BreakerCooldown  time.Duration  // how long updates are suspended for, DefaultBreakerCooldown if 0
+	TLSMinVersion    uint16         // minimum TLS version used to download the source, if not 0
+	TLSRootCAs       *x509.CertPool // certificate authorities trusted to download the source, if not nil
+	SortServers      bool           // return parsed servers sorted by name instead of in file order
+	OnStale          func(*Source)  // called when the cached copy of the source is found to have expired
+	// directory where signatures are looked up if they are not found next to the source, ex: /.well-known/dnscrypt-sigs/
+	SignatureFallbackPath string
+	CacheStore            CacheStore // where the cached copy is stored, local files if nil
+	PinKeys               bool       // refuse to load the source if its keys differ from the ones previously used
+	AcceptKeyChange       bool       // confirm that the keys of a source with pinned keys were intentionally changed
+	Bundle                bool       // URLs serve signature bundles, see SignatureBundleSeparator
+	ExpandEnv             bool       // expand environment variables in URLs and in the cache file path
+	SignatureAfterQuery   bool       // append the signature suffix to the query string of URLs that have one, see signatureURL
+	Priority              int        // sources with a higher priority override others with MergePriority
+	PreferNewest          bool       // download all URLs and use the content with the most recent signature, instead of the first valid one
+	ReuseCachedSignature  bool       // accept content identical to the verified cached copy if its signature can't be downloaded
+	CommentPrefixes       []string   // lines of V2 entries starting with one of these are skipped, DefaultCommentPrefixes if empty
+	SignatureSuffix       string     // added to URLs and cache files to get their signatures, DefaultSignatureSuffix if empty
+	SignatureURLs         []string   // URLs of the signatures of the content at the same index in urls, instead of adding the suffix
+	DisableKeepAlives     bool       // download the source using a new connection for each request, so that requests can't be correlated
+	VerifyCacheSize       int        // number of verified signatures remembered to avoid verifying identical content again, 0 to disable
+	Offline               bool       // only load the source from the cache, without ever contacting its URLs
+	DefaultFilename       string     // added to URLs ending with a slash, which are rejected if it is empty
+	DescribeServers       bool       // attach a ServerDescriptor of their stamp to parsed servers
+	HonorCacheControl     bool       // refresh the source when the Cache-Control or Expires headers say, within the cache TTL
+	MirrorWeights         []int      // weights of the URLs at the same index in urls, to randomly pick the first one tried
+	MirrorRand            *rand.Rand // picks the first URL tried with MirrorWeights, the global source if nil; can be shared by sources
+	Tags                  []string   // added to the tags of every server of the source
+	CheckUTF8             bool       // skip entries that are not valid UTF-8 text, reporting them as parse errors
+	SignatureFirst        bool       // download the signature first, and not the content if the signature is identical to the cached one
+	KeyManifestURL        string     // URL of a list of keys signed with KeyManifestRootKey, added to the keys of the source
+	MirrorStatsWindow     int        // number of recent download durations kept for each URL, see MirrorStats, 0 to disable
+	ServerNamesOnly       bool       // only retain the names of the servers returned by Parse, with an OnParseFailure policy not keeping them
+	SeedFile              string     // bundled copy used if there is no cached copy, with its signature next to it, instead of Seed
+	Seed                  []byte     // bundled copy used if there is no cached copy, so that the source can be used before it is downloaded
+	SeedSignature         []byte     // signature of Seed
+	ChecksumManifest      bool       // check downloads against a signed list of the hashes of the content and the signature, see checksumManifestSuffix
+	NoCacheSignature      bool       // cache only the content, whose signature is downloaded again to verify it when it is loaded, see cacheSignature
+	AcceptFormats         []string   // formats requested in the Accept header in order of preference, used according to the Content-Type of downloads
+	SafeReload            bool       // parse updates before they replace the current content, and reject those listing less than MinServers servers
+	MinServers            int        // minimum number of servers of an update with SafeReload, the min_servers directive of the update or 1 if 0
+	AcceptedStatusCodes   []int      // 2xx status codes of successful downloads, DefaultAcceptedStatusCodes if empty
+	MaxBandwidth          int64      // maximum download rate of the source in bytes per second, unlimited if 0, see also SharedBandwidth
+	TimeoutThroughput     int64      // download rate in bytes per second assumed to extend Timeout according to the Content-Length, if not 0
+	PinnedHash            string     // SHA-256 hash of the only content of the source accepted, see Pin
+	ContentMarker         string     // text the first line of downloads must start with, to reject error pages before verifying them
+	ContentMarkerFold     bool       // ignore differences of case and spacing between ContentMarker and the first line of downloads
+	Resolvers             []string   // resolvers of the host names of the URLs, IP:port or DoH URLs, instead of the ones of the XTransport
+	OverrideFile          string     // local file of changes merged onto the parsed servers, signed with the keys of the source
+	OverrideKeys          []string   // Minisign keys the OverrideFile is signed with, instead of the keys of the source
+	OverrideUnsigned      bool       // accept an OverrideFile without a signature next to it, which is then logged as a warning
+	DedupNames            bool       // keep only the first of the parsed servers with the same name
+	DedupStamps           bool       // keep only the first of the parsed servers with the same stamp, ignoring its properties, see stampIdentity
+	FreshnessJitter       float64    // largest fraction of the cache TTL removed on this instance, up to MaxFreshnessJitter, see freshnessJitter
+	InstanceID            string     // identifies this instance to derive the freshness jitter, the machine ID if empty
+	Tenant                string     // namespace of the source passed to CacheKey, for sources sharing a URL and a cache file across tenants
+	// time allowed to download small files, and files whose length is unknown, DefaultTimeout if 0, see TimeoutThroughput
+	Timeout time.Duration
+	// time allowed to try all the URLs at each refresh before using the cache, DefaultRefreshBudget if 0, negative for no limit
+	RefreshBudget time.Duration
+	// delay between downloading the content and its signature, for CDNs that take a while to serve new signatures, within RefreshBudget
+	SignatureDelay time.Duration
+	// signature schemes tried in order if a minisign signature can't be downloaded or verified, minisign only if empty
+	SignatureSchemes []SignatureScheme
+	// derives the path of the cache file from the cache file, the Tenant and the key IDs of the source, DefaultCacheKey if nil
+	CacheKey CacheKeyFunc
+	// time of day at which the source is refreshed, instead of after the refresh delay, if not nil
+	RefreshAt *DailySchedule
+	// limiter shared with other sources to cap the bandwidth of their downloads together, in addition to MaxBandwidth
+	SharedBandwidth *BandwidthLimiter
+	// periods during which keys can be used, by key ID as displayed by minisign, keys without one are always valid
+	KeyValidity map[string]KeyValidity
+	// how server names are normalized, NameNormalizationNone by default
+	NameNormalization NameNormalization
+	// how the host names in the stamps of the servers are normalized, HostNormalizationNone by default
+	HostNormalization HostNormalization
+	// what to do when verified content can't be parsed, ParseFailureFail by default
+	OnParseFailure ParseFailurePolicy
+	// HTTP version used to download the source, HTTPVersionAuto by default
+	HTTPVersion HTTPVersion
+	// what to do with signatures without a timestamp in their trusted comment, TimestampIgnore by default
+	TimestampPolicy TimestampPolicy
+	// whether the source lists resolvers or relays, SourceRoleMixed by default to accept both
+	Role SourceRole
+	// how long Approve may take before the update is rejected, DefaultApprovalTimeout if 0
+	ApprovalTimeout time.Duration
+	// Approve is called with verified content before it replaces the cached copy and the content of the source, if not nil
+	Approve SourceApprover
+	// Filter skips the servers it returns false for before their stamps are decoded, see NewServerFilter
+	Filter ServerFilter
+	// ScheduleTracer receives the decisions made by PrefetchSources for the source, if not nil
+	ScheduleTracer ScheduleTracer
+	// Tracer receives spans around downloads, signature verifications and parsing, if not nil
+	Tracer SourceTracer
+	// Transform is applied to the verified content of the source before it is parsed, for example to remove an envelope
+	Transform func(bin []byte) ([]byte, error)
+}
+
 type Source struct {
 	name                    string
 	urls                    []*url.URL
 	format                  SourceFormat
 	in                      []byte
-	minisignKey             *minisign.PublicKey
+	rawIn                   []byte // verified content before Transform, only set if Transform is
+	minisignKeys            []sourceKey
+	overrideKeys            []sourceKey // keys the OverrideFile is signed with, if not the ones of the source
 	cacheFile               string
 	cacheTTL, prefetchDelay time.Duration
 	refresh                 time.Time
+	options                 SourceOptions
+	lastSuccessfulURL       string
+	verifyFailures          int             // consecutive refreshes that failed signature verification
+	breakerUntil            time.Time       // network updates are suspended until then
+	transport               *http.Transport // replaces the main transport if TLS or connection settings are overridden, see sourceTransport
+	stale                   bool            // the cached copy has expired and hasn't been refreshed yet
+	refreshLock             sync.Mutex      // only one refresh of the source can run at a time
+	statsLock               sync.Mutex
+	cacheStats              SourceCacheStats
+	// servers returned by the last successful Parse, and the prefix they were parsed with, guarded by statsLock
+	lastGood       []RegisteredServer
+	lastGoodPrefix string
+	parseError     string    // error of the last Parse, even if it returned the last good servers instead, guarded by statsLock
+	lastRefresh    time.Time // last time fetchWithCache ran
+	lastError      string    // error returned by the last fetchWithCache, if any
+	// signature URLs of the content at the same index in urls, if SignatureURLs is set
+	sigURLs     []*url.URL
+	verifyCache *lru.Cache    // see VerifyCacheSize
+	hintedDelay time.Duration // refresh delay set by the caching headers of the last download, see HonorCacheControl
+	weights     []int         // weights of the URLs at the same index in urls, if MirrorWeights is set
+	// recent downloads from each URL, if MirrorStatsWindow is set, guarded by statsLock
+	mirrors map[string]*mirrorHistory
+	// number of keys at the start of minisignKeys that were configured, the next ones come from the key manifest, if KeyManifestURL is set
+	configKeys int
+	// failures of the last cache writes, guarded by statsLock, see CacheWriteHealth
+	cacheWrite CacheWriteHealth
+	// sends HTTP/2 requests to http:// URLs, if HTTPVersion is HTTPVersion2
+	h2c http.RoundTripper
+	// resolves the host names of the URLs, if Resolvers is set
+	resolver HostResolver
+	// main transport of the XTransport that transport and h2c were derived from, guarded by transportLock with them
+	transportBase *http.Transport
+	transportLock sync.Mutex
+	// names of the servers returned by the last Parse, nil if the content changed since then, guarded by statsLock
+	serverNames []string
+	// credentials removed from the URLs, by scheme and host, see takeCredentials
+	credentials map[string]*url.Userinfo
+	// format of the content negotiated with the server it was downloaded from, the configured format if empty, see AcceptFormats
+	negotiatedFormat string
+	// limits the download rate of the source, if MaxBandwidth is set
+	bandwidth *BandwidthLimiter
+	// SHA-256 hash of the only content accepted, nil if the source isn't pinned, guarded by statsLock, see Pin
+	pinnedHash []byte
+	// sources extracted from the content, with Archive, nil until ArchiveSources is called, guarded by archiveLock
+	archive     *sourceArchive
+	archiveLock sync.Mutex
+	// signature of the cached content, if NoCacheSignature is set, nil until it is downloaded
+	cacheSig []byte
+	// state of the source reported by Status, as of the end of the last refresh, guarded by statsLock
+	status statusSnapshot
+}
+
+// SourceCacheStats counts how a source has been refreshed
+type SourceCacheStats struct {
+	CacheHits      uint64 // the cached copy was fresh enough to be used as-is
+	CacheMisses    uint64 // the cached copy was missing, invalid or expired
+	NetworkFetches uint64 // the source had to be downloaded again
+}
+
+// CacheStats returns the cache counters of the source
+func (source *Source) CacheStats() SourceCacheStats {
+	source.statsLock.Lock()
+	defer source.statsLock.Unlock()
+	return source.cacheStats
+}
+
+// SourcesCacheStats returns the sum of the cache counters of the sources
+func SourcesCacheStats(sources []*Source) (total SourceCacheStats) {
+	for _, source := range sources {
+		stats := source.CacheStats()
+		total.CacheHits += stats.CacheHits
+		total.CacheMisses += stats.CacheMisses
+		total.NetworkFetches += stats.NetworkFetches
+	}
+	return
+}
+
+func (source *Source) updateCacheStats(update func(stats *SourceCacheStats)) {
+	source.statsLock.Lock()
+	update(&source.cacheStats)
+	source.statsLock.Unlock()
+}
+
+type sourceKey struct {
+	key   minisign.PublicKey
+	id    string // minisign key ID, as displayed by minisign
+	label string // optional human-readable label
+}
+
+func (key sourceKey) String() string {
+	if len(key.label) == 0 {
+		return key.id
+	}
+	return key.label + " (" + key.id + ")"
+}
+
+// encodedPublicKeyLength is the length of a base64-encoded Minisign public key: the algorithm, the key ID and the Ed25519 key
+const encodedPublicKeyLength = 56
+
+// decodePublicKey checks a Minisign public key string before decoding it, so that mistakes such as a truncated key
+// or a key of another kind are reported clearly. Keys of the right length have no padding, which is rejected, so that
+// they always decode to the algorithm, the key ID and the Ed25519 key.
+func decodePublicKey(keyStr string) (minisignKey minisign.PublicKey, err error) {
+	if len(keyStr) == 0 {
+		return minisignKey, errors.New("Invalid encoded public key: the key is empty")
+	}
+	if len(keyStr) != encodedPublicKeyLength {
+		return minisignKey, fmt.Errorf("Invalid encoded public key: %d characters instead of %d - Make sure that the whole key was copied", len(keyStr), encodedPublicKeyLength)
+	}
+	bin, err := base64.RawStdEncoding.DecodeString(keyStr)
+	if err != nil {
+		return minisignKey, fmt.Errorf("Invalid encoded public key: not valid base64 (%v)", err)
+	}
+	if bin[0] != 'E' || bin[1] != 'd' {
+		return minisignKey, fmt.Errorf("Invalid encoded public key: unsupported signature algorithm %q, only Ed25519 Minisign keys are supported", bin[:2])
+	}
+	return minisign.NewPublicKey(keyStr)
+}
+
+// parseSourceKey decodes a key string, optionally followed by a label
+func parseSourceKey(keyStr string) (sourceKey, error) {
+	var key sourceKey
+	parts := strings.Fields(keyStr)
+	if len(parts) == 0 {
+		parts = []string{""}
+	}
+	minisignKey, err := decodePublicKey(parts[0])
+	if err != nil {
+		return key, err
+	}
+	key.key, key.label = minisignKey, strings.Join(parts[1:], " ")
+	key.id = fmt.Sprintf("%016X", binary.LittleEndian.Uint64(minisignKey.KeyId[:]))
+	return key, nil
+}
+
+// ErrKeyExpired is returned when a signature is verified with a key outside of its validity period, see KeyValidity
+var ErrKeyExpired = errors.New("Key used outside of its validity period")
+
+// KeyValidity is the period during which a key can be used to verify a source, a zero time leaving it open
+type KeyValidity struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// checkKeyValidity returns ErrKeyExpired if the current time is outside of the validity period of a key
+func (source *Source) checkKeyValidity(key sourceKey) error {
+	validity, ok := source.options.KeyValidity[key.id]
+	if !ok {
+		return nil
+	}
+	now := timeNow()
+	if !validity.NotBefore.IsZero() && now.Before(validity.NotBefore) {
+		return fmt.Errorf("%w: key [%s] can't be used before %v", ErrKeyExpired, key, validity.NotBefore)
+	}
+	if !validity.NotAfter.IsZero() && now.After(validity.NotAfter) {
+		return fmt.Errorf("%w: key [%s] was retired on %v", ErrKeyExpired, key, validity.NotAfter)
+	}
+	return nil
+}
+
+// signatureTimestamp returns the time at which a signature was made, according to its trusted comment
+func signatureTimestamp(sig []byte) (time.Time, error) {
+	signature, err := minisign.DecodeSignature(string(sig))
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, field := range strings.Fields(strings.TrimPrefix(signature.TrustedComment, "trusted comment: ")) {
+		if !strings.HasPrefix(field, "timestamp:") {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(strings.TrimPrefix(field, "timestamp:"), 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid timestamp in trusted comment: [%s]", field)
+		}
+		return time.Unix(timestamp, 0), nil
+	}
+	return time.Time{}, errors.New("No timestamp in trusted comment")
 }
 
 func (source *Source) checkSignature(bin, sig []byte) (err error) {
-	var signature minisign.Signature
-	if signature, err = minisign.DecodeSignature(string(sig)); err == nil {
-		_, err = source.minisignKey.Verify(bin, signature)
+	endSpan := source.startSpan("source.verify", nil)
+	defer func() { endSpan(err) }()
+	if err = source.checkMinisignSignature(bin, sig); err != nil {
+		err = source.checkSchemeSignature(bin, sig, err)
 	}
 	return
 }
 
+func (source *Source) checkMinisignSignature(bin, sig []byte) (err error) {
+	var signature minisign.Signature
+	if signature, err = minisign.DecodeSignature(string(sig)); err != nil {
+		return
+	}
+	var verifyKey verifyCacheKey
+	if source.verifyCache != nil {
+		if verifyKey = newVerifyCacheKey(bin, sig); source.alreadyVerified(verifyKey) {
+			for _, key := range source.minisignKeys {
+				if key.key.KeyId == signature.KeyId {
+					dlog.Debugf("Source [%s] signature already verified", source.name)
+					return source.checkKeyValidity(key) // the period may have ended since the signature was verified
+				}
+			}
+			source.verifyCache.Remove(verifyKey) // the key was removed since then, and verifying the signature again rejects it
+		}
+		defer func() {
+			if err == nil {
+				source.addVerified(verifyKey)
+			}
+		}()
+	}
+	var keyErr error
+	var digest contentDigest
+	tried := make([]string, 0, len(source.minisignKeys))
+	for _, key := range source.minisignKeys {
+		if err = verifyWithKey(&key.key, bin, &digest, signature); err == nil {
+			if err = source.checkKeyValidity(key); err != nil {
+				return
+			}
+			dlog.Debugf("Source [%s] signature verified using key [%s]", source.name, key)
+			return
+		}
+		if keyErr == nil || key.key.KeyId == signature.KeyId {
+			keyErr = err // report the error from the key the signature claims to be made with, if any
+		}
+		tried = append(tried, key.String())
+	}
+	return fmt.Errorf("%v - keys tried: [%s]", keyErr, strings.Join(tried, ", "))
+}
+
+// HTTPVersion is the version of HTTP used to download a source.
+// Requests to several URLs of the same server, such as for the content and the signature, share a connection with HTTP/2.
+type HTTPVersion int
+
+const (
+	HTTPVersionAuto HTTPVersion = iota // HTTP/2 is used with https:// URLs if the server supports it, HTTP/1.1 otherwise
+	HTTPVersion1                       // only HTTP/1.1 is used
+	HTTPVersion2                       // HTTP/2 is also tried first with http:// URLs, falling back to HTTP/1.1 if the server doesn't support it
+)
+
+func parseHTTPVersion(str string) (HTTPVersion, error) {
+	switch strings.ToLower(str) {
+	case "", "auto":
+		return HTTPVersionAuto, nil
+	case "1.1", "http/1.1":
+		return HTTPVersion1, nil
+	case "2", "http/2":
+		return HTTPVersion2, nil
+	case "3", "http/3":
+		return HTTPVersionAuto, errors.New("HTTP/3 is not supported to download sources")
+	}
+	return HTTPVersionAuto, fmt.Errorf("Unsupported HTTP version: [%s]", str)
+}
+
+// TimestampPolicy tells what to do with verified signatures whose trusted comment has no valid timestamp
+type TimestampPolicy int
+
+const (
+	TimestampIgnore  TimestampPolicy = iota // signatures are accepted with or without a timestamp
+	TimestampPrefer                         // signatures without a timestamp are accepted with a warning
+	TimestampRequire                        // signatures without a timestamp are rejected
+)
+
+func parseTimestampPolicy(str string) (TimestampPolicy, error) {
+	switch strings.ToLower(str) {
+	case "", "ignore":
+		return TimestampIgnore, nil
+	case "prefer":
+		return TimestampPrefer, nil
+	case "require":
+		return TimestampRequire, nil
+	}
+	return TimestampIgnore, fmt.Errorf("Unsupported timestamp policy: [%s]", str)
+}
+
+// signedTimestamp returns the timestamp of a verified signature, or the zero time if it doesn't have a valid one and the TimestampPolicy allows it
+func (source *Source) signedTimestamp(sig []byte) (time.Time, error) {
+	timestamp, err := signatureTimestamp(sig)
+	if err == nil {
+		return timestamp, nil
+	}
+	switch source.options.TimestampPolicy {
+	case TimestampRequire:
+		return time.Time{}, fmt.Errorf("Source [%s] signature has no valid timestamp, which is required: %v", source.name, err)
+	case TimestampPrefer:
+		dlog.Warnf("Source [%s] signature has no valid timestamp: %v", source.name, err)
+	}
+	return time.Time{}, nil
+}
+
 // timeNow can be replaced by tests to provide a static value
 var timeNow = time.Now
 
-func (source *Source) fetchFromCache(now time.Time) (delay time.Duration, err error) {
-	var bin, sig []byte
-	if bin, err = ioutil.ReadFile(source.cacheFile); err != nil {
+// readCache reads and verifies the cached copy of the source, without changing the source. The content is returned
+// before and after Transform, along with the format negotiated for it.
+func (source *Source) readCache() (bin, in []byte, formatStr string, err error) {
+	var sig []byte
+	store := source.cacheStore()
+	if bin, err = store.Read(source.cacheFile); err != nil {
+		return
+	}
+	if source.options.NoCacheSignature {
+		if sig = source.cacheSig; sig == nil {
+			err = fmt.Errorf("Source [%s] cache file [%s] has no signature to be verified with", source.name, source.cacheFile)
+			return
+		}
+		if err = source.checkSignature(bin, sig); err != nil {
+			return
+		}
+	} else if sig, err = source.cachedSignature(store, bin); err != nil {
+		return
+	}
+	if _, err = source.signedTimestamp(sig); err != nil {
+		return
+	}
+	if err = source.checkPin(bin); err != nil {
+		return
+	}
+	if in, err = source.transformContent(bin); err != nil {
+		return
+	}
+	formatStr, err = source.cachedFormat()
+	return
+}
+
+// cacheSignature downloads the signature of the cached content if NoCacheSignature is set, trying the signature URLs of the
+// content URLs in turn until one verifies the cached content, so that it is never trusted only because it is in the cache.
+// Git and bundle URLs are skipped, since their signatures can't be downloaded separately.
+func (source *Source) cacheSignature(ctx context.Context, xTransport *XTransport) {
+	if !source.options.NoCacheSignature || source.cacheSig != nil || source.options.Bundle {
 		return
 	}
-	if sig, err = ioutil.ReadFile(source.cacheFile + ".minisig"); err != nil {
+	bin, err := source.cacheStore().Read(source.cacheFile)
+	if err != nil {
 		return
 	}
-	if err = source.checkSignature(bin, sig); err != nil {
+	for _, i := range source.mirrorOrder(len(source.urls)) {
+		srcURL := source.urls[i]
+		if isGitURL(srcURL) {
+			continue
+		}
+		sig, sigURL, err := source.fetchSignature(ctx, xTransport, srcURL, source.contentSigURL(i, srcURL))
+		if err == nil {
+			if err = source.checkSignature(bin, sig); err == nil {
+				dlog.Debugf("Source [%s] cache file [%s] verified with the signature from URL [%s]", source.name, source.cacheFile, redactedURL(sigURL))
+				source.cacheSig = sig
+				return
+			}
+		}
+		dlog.Debugf("Source [%s] cache file [%s] can't be verified with the signature from URL [%s]: %v", source.name, source.cacheFile, redactedURL(sigURL), err)
+	}
+}
+
+func (source *Source) fetchFromCache(ctx context.Context, xTransport *XTransport, now time.Time) (delay time.Duration, err error) {
+	source.cacheSignature(ctx, xTransport)
+	bin, in, formatStr, err := source.readCache()
+	if err != nil {
 		return
 	}
-	source.in = bin
-	var fi os.FileInfo
-	if fi, err = os.Stat(source.cacheFile); err != nil {
+	source.negotiatedFormat = formatStr
+	if source.options.OnParseFailure == ParseFailureRefresh {
+		if err = source.checkParsable(in); err != nil {
+			dlog.Warnf("Source [%s] cache file [%s] has a valid signature but can't be parsed, downloading it again: %v", source.name, source.cacheFile, err)
+			return
+		}
+	}
+	source.setContent(bin, in)
+	source.lastSuccessfulURL = ""
+	var modTime time.Time
+	if modTime, err = source.cacheStore().Stat(source.cacheFile); err != nil {
 		return
 	}
-	if elapsed := now.Sub(fi.ModTime()); elapsed < source.cacheTTL {
-		delay = source.prefetchDelay - elapsed
+	if elapsed := now.Sub(modTime); elapsed < source.cacheTTL {
+		source.stale = false
+		delay = source.scheduledDelay(modTime, now)
 		dlog.Debugf("Source [%s] cache file [%s] is still fresh, next update: %v", source.name, source.cacheFile, delay)
 	} else {
 		dlog.Debugf("Source [%s] cache file [%s] needs to be refreshed", source.name, source.cacheFile)
+		if !source.stale {
+			source.stale = true
+			if source.options.OnStale != nil {
+				source.options.OnStale(source)
+			}
+		}
 	}
 	return
 }
 
-func writeSource(f string, bin, sig []byte) (err error) {
-	var fSrc, fSig *safefile.File
-	if fSrc, err = safefile.Create(f, 0644); err != nil {
-		return
+func (source *Source) transformContent(bin []byte) ([]byte, error) {
+	if source.options.Transform == nil {
+		return bin, nil
+	}
+	in, err := source.options.Transform(bin)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to transform the content of source [%s]: %v", source.name, err)
+	}
+	return in, nil
+}
+
+func (source *Source) setContent(raw, in []byte) {
+	if !bytes.Equal(source.in, in) {
+		source.statsLock.Lock()
+		source.serverNames = nil
+		source.statsLock.Unlock()
 	}
-	defer fSrc.Close()
-	if fSig, err = safefile.Create(f+".minisig", 0644); err != nil {
+	source.in = in
+	if source.options.Transform != nil {
+		source.rawIn = raw
+	}
+	if source.options.Archive {
+		source.refreshArchive()
+	}
+}
+
+// rawContent returns the verified content of the source, as cached
+func (source *Source) rawContent() []byte {
+	if source.options.Transform != nil {
+		return source.rawIn
+	}
+	return source.in
+}
+
+// pendingSignatureSuffix is added to the name of the signature cache file to get the name of the file the signature of new
+// content is written to before the content itself, see writeSource
+const pendingSignatureSuffix = ".pending"
+
+// writeSource writes content and its signature as a pair: the signature is first written to a pending file, then the content,
+// then the signature, and the pending file is only removed once both are written. If the write is interrupted, the cache
+// keeps a signature of whichever content it ends up with, see cachedSignature.
+func writeSource(ctx context.Context, store CacheStore, f, sigFile string, bin, sig []byte) (err error) {
+	pendingSigFile := sigFile + pendingSignatureSuffix
+	if err = store.Write(ctx, pendingSigFile, sig); err != nil {
 		return
 	}
-	defer fSig.Close()
-	if _, err = fSrc.Write(bin); err != nil {
+	if err = store.Write(ctx, f, bin); err != nil {
 		return
 	}
-	if _, err = fSig.Write(sig); err != nil {
+	if err = store.Write(ctx, sigFile, sig); err != nil {
 		return
 	}
-	if err = fSrc.Commit(); err != nil {
+	return store.Remove(pendingSigFile)
+}
+
+// cachedSignature returns the cached signature of bin, the cached content, once verified. If the content was written but
+// not its signature, the pending signature written before the content is used instead.
+func (source *Source) cachedSignature(store CacheStore, bin []byte) (sig []byte, err error) {
+	if sig, err = store.Read(source.sigCacheFile()); err == nil {
+		if err = source.checkSignature(bin, sig); err == nil {
+			return
+		}
+	}
+	pendingSig, pendingErr := store.Read(source.sigCacheFile() + pendingSignatureSuffix)
+	if pendingErr != nil || source.checkSignature(bin, pendingSig) != nil {
 		return
 	}
-	return fSig.Commit()
+	dlog.Noticef("Source [%s] cache file [%s] was written without its signature, using the pending signature", source.name, source.cacheFile)
+	return pendingSig, nil
+}
+
+// writeCache writes verified content and its signature to the cache, or only the content with NoCacheSignature,
+// removing a signature cached before the option was set so that it can't be mistaken for the signature of the new content
+func (source *Source) writeCache(ctx context.Context, store CacheStore, bin, sig []byte) error {
+	if !source.options.NoCacheSignature {
+		return writeSource(ctx, store, source.cacheFile, source.sigCacheFile(), bin, sig)
+	}
+	if err := store.Write(ctx, source.cacheFile, bin); err != nil {
+		return err
+	}
+	return store.Remove(source.sigCacheFile())
+}
+
+// signatureSuffix returns the suffix added to URLs and cache files to get their signatures
+func (source *Source) signatureSuffix() string {
+	if len(source.options.SignatureSuffix) > 0 {
+		return source.options.SignatureSuffix
+	}
+	return DefaultSignatureSuffix
+}
+
+// checkSignatureSuffix rejects suffixes that wouldn't only extend the name of the files of the source, such as the ones
+// changing the directory of the cache file, or the path of the URLs, and suffixes of the other files cached with the source
+func checkSignatureSuffix(suffix string) error {
+	if strings.ContainsAny(suffix, "/\\?#") || strings.IndexFunc(suffix, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return fmt.Errorf("signature suffix [%s] can't be used in file names and URLs", suffix)
+	}
+	if suffix == ".meta" || suffix == pendingSignatureSuffix {
+		return fmt.Errorf("signature suffix [%s] is used by other cache files", suffix)
+	}
+	return nil
+}
+
+func (source *Source) sigCacheFile() string {
+	return source.cacheFile + source.signatureSuffix()
+}
+
+func (source *Source) cacheStore() CacheStore {
+	if source.options.CacheStore != nil {
+		return source.options.CacheStore
+	}
+	return fileCacheStore{}
 }
 
-func (source *Source) writeToCache(bin, sig []byte, now time.Time) {
+func (source *Source) writeToCache(ctx context.Context, bin, sig []byte, now time.Time) {
 	f := source.cacheFile
+	if suspendedUntil := source.CacheWriteHealth().SuspendedUntil; now.Before(suspendedUntil) {
+		dlog.Debugf("Source [%s] cache writes are suspended until %v", source.name, suspendedUntil)
+		return
+	}
 	var writeErr error // an error writing cache isn't fatal
 	defer func() {
-		source.in = bin
 		if writeErr == nil {
+			source.recordCacheWrite(nil, now)
 			return
 		}
 		if absPath, absErr := filepath.Abs(f); absErr == nil {
 			f = absPath
 		}
-		dlog.Warnf("%s: %s", f, writeErr)
+		if !isDiskFull(writeErr) {
+			dlog.Warnf("%s: %s", f, writeErr)
+		}
+		source.recordCacheWrite(writeErr, now)
 	}()
-	if !bytes.Equal(source.in, bin) {
-		if writeErr = writeSource(f, bin, sig); writeErr != nil {
+	store := source.cacheStore()
+	if source.options.NoCacheSignature && sig != nil {
+		source.cacheSig = sig
+	}
+	if !bytes.Equal(source.rawContent(), bin) {
+		if writeErr = source.writeCache(ctx, store, bin, sig); writeErr != nil {
 			return
 		}
 	}
-	writeErr = os.Chtimes(f, now, now)
+	writeErr = store.Touch(f, now)
 }
 
-func (source *Source) parseURLs(urls []string) {
-	for _, urlStr := range urls {
-		if srcURL, err := url.Parse(urlStr); err != nil {
-			dlog.Warnf("Source [%s] failed to parse URL [%s]", source.name, urlStr)
-		} else {
-			source.urls = append(source.urls, srcURL)
+// expandEnv replaces ${VAR} and $VAR references in str with the values of the environment variables, which must be set
+func (source *Source) expandEnv(what, str string) (string, error) {
+	var unset []string
+	expanded := os.Expand(str, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
 		}
+		return value
+	})
+	if len(unset) > 0 {
+		return "", fmt.Errorf("Source [%s] %s [%s] refers to unset environment variables: %s", source.name, what, redactURL(str), strings.Join(unset, ", "))
 	}
+	if expanded != str {
+		dlog.Debugf("Source [%s] %s [%s] expanded to [%s]", source.name, what, redactURL(str), redactURL(expanded))
+	}
+	return expanded, nil
 }
 
-func fetchFromURL(xTransport *XTransport, u *url.URL) (bin []byte, err error) {
-	bin, _, _, err = xTransport.Get(u, "", DefaultTimeout)
-	return bin, err
+// isDirectoryURL tells if an HTTP URL refers to a directory instead of a file
+func isDirectoryURL(u *url.URL) bool {
+	return (u.Scheme == "http" || u.Scheme == "https") && (u.Path == "" || strings.HasSuffix(u.Path, "/"))
 }
 
-func (source *Source) fetchWithCache(xTransport *XTransport, now time.Time) (delay time.Duration, err error) {
-	if delay, err = source.fetchFromCache(now); err != nil {
-		if len(source.urls) == 0 {
-			dlog.Errorf("Source [%s] cache file [%s] not present and no valid URL", source.name, source.cacheFile)
-			return
+// prepareURLs checks that sigURLs and the mirror weights of the source match urls,
+// and returns the URLs and signature URLs with environment variables expanded if ExpandEnv is set
+func (source *Source) prepareURLs(urls, sigURLs []string) (_, _ []string, err error) {
+	if len(sigURLs) > 0 && len(sigURLs) != len(urls) {
+		return nil, nil, fmt.Errorf("Source [%s] has %d signature URLs for %d URLs", source.name, len(sigURLs), len(urls))
+	}
+	if len(source.options.MirrorWeights) > 0 && len(source.options.MirrorWeights) != len(urls) {
+		return nil, nil, fmt.Errorf("Source [%s] has %d mirror weights for %d URLs", source.name, len(source.options.MirrorWeights), len(urls))
+	}
+	for _, weight := range source.options.MirrorWeights {
+		if weight < 0 {
+			return nil, nil, fmt.Errorf("Source [%s] has a negative mirror weight", source.name)
 		}
-		dlog.Debugf("Source [%s] cache file [%s] not present", source.name, source.cacheFile)
 	}
-	if len(source.urls) > 0 {
-		defer func() {
-			source.refresh = now.Add(delay)
-		}()
+	if !source.options.ExpandEnv {
+		return urls, sigURLs, nil
 	}
-	if len(source.urls) == 0 || delay > 0 {
-		return
+	expandedURLs := make([]string, 0, len(urls))
+	for _, urlStr := range urls {
+		if urlStr, err = source.expandEnv("URL", urlStr); err != nil {
+			return nil, nil, err
+		}
+		expandedURLs = append(expandedURLs, urlStr)
 	}
-	delay = MinimumPrefetchInterval
-	var bin, sig []byte
-	for _, srcURL := range source.urls {
-		dlog.Infof("Source [%s] loading from URL [%s]", source.name, srcURL)
-		sigURL := &url.URL{}
-		*sigURL = *srcURL // deep copy to avoid parsing twice
-		sigURL.Path += ".minisig"
-		if bin, err = fetchFromURL(xTransport, srcURL); err != nil {
-			dlog.Debugf("Source [%s] failed to download from URL [%s]", source.name, srcURL)
-			continue
+	expandedSigURLs := make([]string, 0, len(sigURLs))
+	for _, urlStr := range sigURLs {
+		if urlStr, err = source.expandEnv("signature URL", urlStr); err != nil {
+			return nil, nil, err
 		}
-		if sig, err = fetchFromURL(xTransport, sigURL); err != nil {
-			dlog.Debugf("Source [%s] failed to download signature from URL [%s]", source.name, sigURL)
+		expandedSigURLs = append(expandedSigURLs, urlStr)
+	}
+	return expandedURLs, expandedSigURLs, nil
+}
+
+func (source *Source) parseURLs(urls, sigURLs []string) error {
+	for i, urlStr := range urls {
+		srcURL, err := url.Parse(urlStr)
+		if err != nil {
+			dlog.Warnf("Source [%s] failed to parse URL [%s]", source.name, redactURL(urlStr))
 			continue
 		}
-		if err = source.checkSignature(bin, sig); err == nil {
-			break // valid signature
-		} // above err check inverted to make use of implicit continue
-		dlog.Debugf("Source [%s] failed signature check using URL [%s]", source.name, srcURL)
-	}
-	if err != nil {
-		return
+		source.takeCredentials(srcURL)
+		if isDirectoryURL(srcURL) {
+			filename := source.options.DefaultFilename
+			if len(filename) == 0 {
+				return fmt.Errorf("URL [%s] of source [%s] refers to a directory - Add the name of the file to it, ex: [%s]",
+					redactedURL(srcURL), source.name, strings.TrimSuffix(redactedURL(srcURL), "/")+"/public-resolvers.md")
+			}
+			if !strings.HasSuffix(srcURL.Path, "/") {
+				srcURL.Path += "/"
+			}
+			if len(srcURL.RawPath) > 0 {
+				srcURL.RawPath += url.PathEscape(filename)
+			}
+			srcURL.Path += filename
+			dlog.Debugf("Source [%s] URL [%s] refers to a directory, using [%s]", source.name, redactURL(urlStr), redactedURL(srcURL))
+		}
+		if len(sigURLs) > 0 {
+			sigURL, err := url.Parse(sigURLs[i])
+			if err != nil {
+				dlog.Warnf("Source [%s] failed to parse signature URL [%s], ignoring URL [%s]", source.name, redactURL(sigURLs[i]), redactedURL(srcURL))
+				continue
+			}
+			source.takeCredentials(sigURL)
+			source.sigURLs = append(source.sigURLs, sigURL)
+		}
+		if len(source.options.MirrorWeights) > 0 {
+			source.weights = append(source.weights, source.options.MirrorWeights[i])
+		}
+		source.urls = append(source.urls, srcURL)
 	}
-	source.writeToCache(bin, sig, now)
-	delay = source.prefetchDelay
-	return
+	return nil
 }
 
-// NewSource loads a new source using the given cacheFile and urls, ensuring it has a valid signature
-func NewSource(name string, xTransport *XTransport, urls []string, minisignKeyStr string, cacheFile string, formatStr string, refreshDelay time.Duration) (source *Source, err error) {
-	if refreshDelay < DefaultPrefetchDelay {
-		refreshDelay = DefaultPrefetchDelay
+// s3Scheme is the scheme of the URLs of sources stored in S3-compatible object storage, see fetchFromS3
+const s3Scheme = "s3"
+
+// gitURLPrefix starts the URLs of sources stored in Git repositories, see fetchFromGit
+const gitURLPrefix = "git+"
+
+func isGitURL(u *url.URL) bool {
+	return strings.HasPrefix(u.Scheme, gitURLPrefix)
+}
+
+// gitSchemes are the transports of the repositories Git URLs can refer to, so that helpers such as ext:: are never used
+var gitSchemes = map[string]bool{"https": true, "http": true, "ssh": true, "git": true, "file": true}
+
+// parseGitURL splits a Git source URL, such as git+https://host/repo.git?ref=main&path=lists/public-resolvers.md,
+// into the URL of the repository, the ref to fetch (HEAD by default) and the path of the source in the repository.
+// Refs and repositories starting with a dash are rejected, so that they can't be taken for options of the git command.
+func parseGitURL(u *url.URL) (repo, ref, filePath string, err error) {
+	scheme := strings.TrimPrefix(u.Scheme, gitURLPrefix)
+	if !gitSchemes[scheme] {
+		return "", "", "", fmt.Errorf("Unsupported Git URL scheme: [%s]", u.Scheme)
 	}
-	source = &Source{name: name, urls: []*url.URL{}, cacheFile: cacheFile, cacheTTL: refreshDelay, prefetchDelay: DefaultPrefetchDelay}
-	if formatStr == "v2" {
-		source.format = SourceFormatV2
-	} else {
-		return source, fmt.Errorf("Unsupported source format: [%s]", formatStr)
+	if scheme != "file" && len(u.Host) == 0 {
+		return "", "", "", errors.New("Missing host in Git URL")
 	}
-	if minisignKey, err := minisign.NewPublicKey(minisignKeyStr); err == nil {
-		source.minisignKey = &minisignKey
-	} else {
-		return source, err
+	query := u.Query()
+	if filePath = strings.TrimPrefix(query.Get("path"), "/"); len(filePath) == 0 {
+		return "", "", "", errors.New("Missing path in Git URL")
 	}
-	source.parseURLs(urls)
-	if _, err = source.fetchWithCache(xTransport, timeNow()); err == nil {
-		dlog.Noticef("Source [%s] loaded", name)
+	if ref = query.Get("ref"); len(ref) == 0 {
+		ref = "HEAD"
+	} else if strings.HasPrefix(ref, "-") {
+		return "", "", "", fmt.Errorf("Invalid ref in Git URL: [%s]", ref)
 	}
-	return
+	repoURL := *u
+	repoURL.Scheme, repoURL.RawQuery, repoURL.Fragment = scheme, "", ""
+	return repoURL.String(), ref, filePath, nil
 }
 
-// PrefetchSources downloads latest versions of given sources, ensuring they have a valid signature before caching
-func PrefetchSources(xTransport *XTransport, sources []*Source) time.Duration {
-	now := timeNow()
-	interval := MinimumPrefetchInterval
-	for _, source := range sources {
-		if source.refresh.IsZero() || source.refresh.After(now) {
-			continue
-		}
-		dlog.Debugf("Prefetching [%s]", source.name)
-		if delay, err := source.fetchWithCache(xTransport, now); err != nil {
-			dlog.Infof("Prefetching [%s] failed: %v", source.name, err)
-		} else {
-			dlog.Debugf("Prefetching [%s] succeeded, next update: %v", source.name, delay)
-			if delay >= MinimumPrefetchInterval && (interval == MinimumPrefetchInterval || interval > delay) {
-				interval = delay
-			}
+// gitCommitURL returns a Git URL pinned to a commit, that can be used to fetch the same content again
+func gitCommitURL(u *url.URL, commit string) *url.URL {
+	commitURL := *u
+	query := u.Query()
+	query.Set("ref", commit)
+	commitURL.RawQuery = query.Encode()
+	return &commitURL
+}
+
+// isCommitHash tells if a Git ref is a full commit hash, that doesn't need to be resolved
+func isCommitHash(ref string) bool {
+	if len(ref) != 40 {
+		return false
+	}
+	for _, c := range ref {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
 		}
 	}
-	return interval
+	return true
 }
 
-func (source *Source) Parse(prefix string) ([]RegisteredServer, error) {
-	if source.format == SourceFormatV2 {
-		return source.parseV2(prefix)
+func (source *Source) fetchFromURL(ctx context.Context, xTransport *XTransport, u *url.URL) ([]byte, error) {
+	bin, _, err := source.fetchURL(ctx, xTransport, "GET", u, nil)
+	return bin, err
+}
+
+// DefaultAcceptedStatusCodes are the status codes of successful downloads, unless AcceptedStatusCodes is set.
+// 206 is also accepted in response to requests for a range, such as the ones sent by Probe.
+var DefaultAcceptedStatusCodes = []int{http.StatusOK}
+
+// acceptedStatusCodes returns the status codes accepted in response to a request with the given headers
+func (source *Source) acceptedStatusCodes(header http.Header) []int {
+	accepted := source.options.AcceptedStatusCodes
+	if len(accepted) == 0 {
+		accepted = DefaultAcceptedStatusCodes
 	}
-	dlog.Fatal("Unexpected source format")
-	return []RegisteredServer{}, nil
+	if len(header.Get("Range")) > 0 {
+		accepted = append(append([]int{}, accepted...), http.StatusPartialContent)
+	}
+	return accepted
 }
 
-func (source *Source) parseV2(prefix string) ([]RegisteredServer, error) {
-	var registeredServers []RegisteredServer
-	var stampErrs []string
-	appendStampErr := func(format string, a ...interface{}) {
-		stampErr := fmt.Sprintf(format, a...)
-		stampErrs = append(stampErrs, stampErr)
-		dlog.Warn(stampErr)
+// fetchTimeout returns the time allowed to download a file of the source. Throttled downloads can't be faster than
+// the tightest bandwidth limit, so the time needed to download the Content-Length at that rate is allowed as well.
+func (source *Source) fetchTimeout() FetchTimeout {
+	timeout := FetchTimeout{Base: source.options.Timeout, Throughput: source.options.TimeoutThroughput}
+	if timeout.Base <= 0 {
+		timeout.Base = DefaultTimeout
 	}
-	in := string(source.in)
-	parts := strings.Split(in, "## ")
-	if len(parts) < 2 {
-		return registeredServers, fmt.Errorf("Invalid format for source at [%v]", source.urls)
+	if throughput := source.maxThroughput(); throughput > 0 && (timeout.Throughput <= 0 || throughput < timeout.Throughput) {
+		timeout.Throughput = throughput
 	}
-	parts = parts[1:]
-PartsLoop:
-	for _, part := range parts {
-		part = strings.TrimFunc(part, unicode.IsSpace)
-		subparts := strings.Split(part, "\n")
-		if len(subparts) < 2 {
-			return registeredServers, fmt.Errorf("Invalid format for source at [%v]", source.urls)
-		}
-		name := strings.TrimFunc(subparts[0], unicode.IsSpace)
-		if len(name) == 0 {
-			return registeredServers, fmt.Errorf("Invalid format for source at [%v]", source.urls)
-		}
-		subparts = subparts[1:]
-		name = prefix + name
-		var stampStr, description string
-		for _, subpart := range subparts {
-			subpart = strings.TrimFunc(subpart, unicode.IsSpace)
-			if strings.HasPrefix(subpart, "sdns:") {
-				if len(stampStr) > 0 {
-					appendStampErr("Multiple stamps for server [%s]", name)
-					continue PartsLoop
-				}
-				stampStr = subpart
-				continue
-			} else if len(subpart) == 0 || strings.HasPrefix(subpart, "//") {
+	return timeout
+}
+
+// ErrTruncatedDownload is returned when a file of a source is shorter than the Content-Length announced by the server,
+// so that a transfer cut off by the connection or the server is not mistaken for invalid content
+var ErrTruncatedDownload = errors.New("Truncated download")
+
+// truncatedDownload returns an ErrTruncatedDownload if err tells that the response from u ended before its Content-Length
+func truncatedDownload(err error, u *url.URL) error {
+	var shortErr *shortBodyError
+	if errors.As(err, &shortErr) {
+		return fmt.Errorf("%w: received %d of the %d bytes announced by [%s]: %v", ErrTruncatedDownload, shortErr.received, shortErr.announced, redactedURL(u), shortErr.err)
+	}
+	return err
+}
+
+// sourceTransport returns the transport of the source, and the one sending HTTP/2 requests to http:// URLs, if any.
+// Sources overriding TLS or connection settings get their own transport, derived from the main one of the XTransport,
+// and derived again once the main one is rebuilt, so that they follow the changes of its settings.
+func (source *Source) sourceTransport(xTransport *XTransport) (*http.Transport, http.RoundTripper) {
+	options := source.options
+	if options.TLSMinVersion == 0 && options.TLSRootCAs == nil && !options.DisableKeepAlives && options.HTTPVersion == HTTPVersionAuto && source.resolver == nil {
+		return xTransport.transport, nil
+	}
+	source.transportLock.Lock()
+	defer source.transportLock.Unlock()
+	if source.transport != nil && source.transportBase == xTransport.transport {
+		return source.transport, source.h2c
+	}
+	if source.transport != nil {
+		dlog.Debugf("Source [%s] transport rebuilt", source.name)
+		source.transport.CloseIdleConnections()
+	}
+	if closer, ok := source.h2c.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+	source.transport, source.h2c = xTransport.transportWithTLS(options.TLSMinVersion, options.TLSRootCAs, source.resolver), nil
+	source.transport.DisableKeepAlives = options.DisableKeepAlives
+	switch options.HTTPVersion {
+	case HTTPVersion1:
+		disableHTTP2(source.transport)
+	case HTTPVersion2:
+		source.h2c = h2cTransport(source.transport)
+	}
+	source.transportBase = xTransport.transport
+	return source.transport, source.h2c
+}
+
+// fetchURL sends a request to a URL of the source, using the transport of the source or a Unix socket
+func (source *Source) fetchURL(ctx context.Context, xTransport *XTransport, method string, u *url.URL, header http.Header) (bin []byte, respHeader http.Header, err error) {
+	u, header = source.authenticate(u, header)
+	endSpan := source.startSpan("source.fetch", u)
+	defer func() { endSpan(err) }()
+	acceptedStatus := source.acceptedStatusCodes(header)
+	if u.Scheme == unixSocketScheme {
+		return source.fetchFromUnixSocket(ctx, xTransport, method, u, header, acceptedStatus)
+	}
+	transport, h2c := source.sourceTransport(xTransport)
+	if len(source.options.Resolvers) > 0 {
+		ctx = withOwnResolver(ctx)
+	}
+	throttled := source.throttle(transport)
+	if u.Scheme == s3Scheme {
+		bin, respHeader, err = source.fetchFromS3(ctx, xTransport, throttled, method, u, header, acceptedStatus)
+		return bin, respHeader, truncatedDownload(err, u)
+	}
+	if h2c != nil && u.Scheme == "http" {
+		if bin, _, respHeader, _, err = xTransport.fetch(ctx, source.throttle(h2c), method, u, acceptEncodings(header), acceptedStatus, nil, source.fetchTimeout()); err == nil {
+			bin, err = decodeContent(bin, respHeader)
+			return bin, respHeader, err
+		}
+		if err = truncatedDownload(err, u); errors.Is(err, ErrTruncatedDownload) || ctx.Err() != nil || !h2cUnsupported(err) {
+			return
+		}
+		dlog.Debugf("Source [%s] URL [%s] doesn't support HTTP/2, using HTTP/1.1: %v", source.name, redactedURL(u), err)
+	}
+	if bin, _, respHeader, _, err = xTransport.fetch(ctx, throttled, method, u, acceptEncodings(header), acceptedStatus, nil, source.fetchTimeout()); err != nil {
+		return nil, nil, truncatedDownload(err, u)
+	}
+	bin, err = decodeContent(bin, respHeader)
+	return bin, respHeader, err
+}
+
+// h2cUnsupported tells if err shows that a server doesn't speak HTTP/2 without TLS, so that HTTP/1.1 can be used instead.
+// Other errors, such as timeouts and error statuses, would be the same with HTTP/1.1.
+func h2cUnsupported(err error) bool {
+	var connErr http2.ConnectionError
+	var goAwayErr http2.GoAwayError
+	var streamErr http2.StreamError
+	switch {
+	case errors.As(err, &connErr), errors.As(err, &goAwayErr):
+		return true
+	case errors.As(err, &streamErr):
+		return streamErr.Code == http2.ErrCodeProtocol || streamErr.Code == http2.ErrCodeHTTP11Required
+	}
+	// HTTP/1.1 servers close the connection after rejecting the HTTP/2 connection preface
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// maxCacheControlAge is the largest max-age value accepted, as recommended by RFC 7234
+const maxCacheControlAge = 1 << 31
+
+// cacheControlTTL returns how long a response can be cached according to its Cache-Control or Expires header, if it has one
+func cacheControlTTL(header http.Header, now time.Time) (time.Duration, bool) {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-cache" || directive == "no-store" {
+			return 0, true
+		}
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		if seconds, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64); err == nil && seconds >= 0 {
+			if seconds > maxCacheControlAge {
+				seconds = maxCacheControlAge
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if expires := header.Get("Expires"); len(expires) > 0 {
+		expiration, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, true // invalid dates mean that the response has already expired
+		}
+		return expiration.Sub(now), true
+	}
+	return 0, false
+}
+
+// refreshDelay returns how long downloaded content is used before the source is refreshed
+func (source *Source) refreshDelay() time.Duration {
+	if source.hintedDelay > 0 {
+		return source.hintedDelay
+	}
+	return source.prefetchDelay
+}
+
+// applyCacheControl sets the refresh delay from the caching headers of a download, between MinimumPrefetchInterval and cacheTTL
+func (source *Source) applyCacheControl(header http.Header, now time.Time) {
+	source.hintedDelay = 0
+	ttl, ok := cacheControlTTL(header, now)
+	if !source.options.HonorCacheControl || !ok {
+		return
+	}
+	if ttl < MinimumPrefetchInterval {
+		ttl = MinimumPrefetchInterval
+	} else if ttl > source.cacheTTL {
+		ttl = source.cacheTTL
+	}
+	source.hintedDelay = ttl
+	dlog.Debugf("Source [%s] refresh delay set to %v by the caching headers", source.name, ttl)
+}
+
+// signatureURL returns the URL of the signature of srcURL. The suffix is appended to the path, so that with ".minisig",
+// https://host/list.md?token=abc is signed by https://host/list.md.minisig?token=abc, or, if afterQuery is set, to the
+// query string, as in https://host/list.md?token=abc.minisig. Fragments are never sent to servers and are removed.
+func signatureURL(srcURL *url.URL, suffix string, afterQuery bool) *url.URL {
+	sigURL := &url.URL{}
+	*sigURL = *srcURL // deep copy to avoid parsing twice
+	sigURL.Fragment = ""
+	if afterQuery && (len(sigURL.RawQuery) > 0 || sigURL.ForceQuery) {
+		sigURL.RawQuery += suffix
+		return sigURL
+	}
+	sigURL.Path += suffix
+	if len(sigURL.RawPath) > 0 {
+		sigURL.RawPath += suffix
+	}
+	return sigURL
+}
+
+// signatureFallbackURL returns the URL of the signature of srcURL when stored in a dedicated directory of the same host
+func signatureFallbackURL(srcURL *url.URL, fallbackPath, suffix string) *url.URL {
+	sigURL := &url.URL{}
+	*sigURL = *srcURL
+	sigURL.Path, sigURL.RawPath = path.Join("/", fallbackPath, path.Base(srcURL.Path)+suffix), ""
+	return sigURL
+}
+
+// retryableSignatureError tells if downloading a signature again may succeed. A missing signature is only waited for
+// if the source sets SignatureDelay, since its servers are then known to publish signatures after the content.
+func (source *Source) retryableSignatureError(err error) bool {
+	if statusErr, ok := err.(*HTTPStatusError); ok && statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 {
+		switch statusErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return true
+		case http.StatusNotFound:
+			return source.options.SignatureDelay > 0
+		}
+		return false
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// fetchSignatureFromURL downloads a signature with the Accept header of the content, so that a server negotiating
+// the format of the content can send the signature of the variant it serves, see AcceptFormats
+func (source *Source) fetchSignatureFromURL(ctx context.Context, xTransport *XTransport, sigURL *url.URL) ([]byte, error) {
+	sig, _, err := source.fetchURL(ctx, xTransport, "GET", sigURL, source.acceptHeader())
+	return sig, err
+}
+
+// fetchSignatureWithRetries downloads a signature, retrying with a jittered exponential backoff on transient errors
+func (source *Source) fetchSignatureWithRetries(ctx context.Context, xTransport *XTransport, sigURL *url.URL) (sig []byte, err error) {
+	for attempt := 0; ; attempt++ {
+		if sig, err = source.fetchSignatureFromURL(ctx, xTransport, sigURL); err == nil || attempt >= signatureRetries || !source.retryableSignatureError(err) {
+			return
+		}
+		backoff := signatureRetryBackoff << uint(attempt)
+		backoff += time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+		dlog.Debugf("Source [%s] failed to download signature from URL [%s], retrying in %v: %v", source.name, redactedURL(sigURL), backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (source *Source) fetchSignature(ctx context.Context, xTransport *XTransport, srcURL, sigURL *url.URL) (sig []byte, _ *url.URL, err error) {
+	if sig, err = source.fetchSignatureWithRetries(ctx, xTransport, sigURL); err != nil {
+		if statusErr, ok := err.(*HTTPStatusError); ok && statusErr.StatusCode == http.StatusNotFound && len(source.options.SignatureFallbackPath) > 0 {
+			dlog.Debugf("Source [%s] signature not found at URL [%s]", source.name, redactedURL(sigURL))
+			sigURL = signatureFallbackURL(srcURL, source.options.SignatureFallbackPath, source.signatureSuffix())
+			sig, err = source.fetchSignatureFromURL(ctx, xTransport, sigURL)
+		}
+		if err != nil {
+			dlog.Debugf("Source [%s] failed to download signature from URL [%s]", source.name, redactedURL(sigURL))
+		}
+	}
+	return sig, sigURL, err
+}
+
+// reusableSignature returns the cached signature if bin is identical to the verified cached content and
+// the source allows reusing it, nil otherwise
+func (source *Source) reusableSignature(bin []byte) []byte {
+	if !source.options.ReuseCachedSignature || len(source.rawContent()) == 0 || !bytes.Equal(source.rawContent(), bin) {
+		return nil
+	}
+	sig, err := source.cacheStore().Read(source.sigCacheFile())
+	if err != nil {
+		return nil
+	}
+	return sig
+}
+
+// contentSigURL returns the URL of the signature of the content at srcURL, the URL at index i in urls
+func (source *Source) contentSigURL(i int, srcURL *url.URL) *url.URL {
+	if len(source.sigURLs) > 0 {
+		return source.sigURLs[i]
+	}
+	return signatureURL(srcURL, source.signatureSuffix(), source.options.SignatureAfterQuery)
+}
+
+// signatureUnchanged returns true if sig is identical to the signature of the cached copy the content of the source was loaded from
+func (source *Source) signatureUnchanged(sig []byte) bool {
+	if len(source.rawContent()) == 0 {
+		return false
+	}
+	cachedSig, err := source.cacheStore().Read(source.sigCacheFile())
+	return err == nil && bytes.Equal(cachedSig, sig)
+}
+
+func (source *Source) checkDownloadSize(bin []byte) error {
+	minSize := source.options.MinDownloadSize
+	if minSize <= 0 {
+		return nil
+	}
+	if len(bin) < minSize {
+		return fmt.Errorf("Download too short: %d bytes, expected at least %d", len(bin), minSize)
+	}
+	return nil
+}
+
+// checkContentMarker returns an error if ContentMarker is set and the first line of bin doesn't start with it, so that error
+// pages and wrong files are rejected before their signature is verified. With ContentMarkerFold, differences of case and spacing are ignored.
+func (source *Source) checkContentMarker(bin []byte) error {
+	marker := source.options.ContentMarker
+	if len(marker) == 0 {
+		return nil
+	}
+	line := bin
+	if idx := bytes.IndexByte(bin, '\n'); idx >= 0 {
+		line = bin[:idx]
+	}
+	firstLine := strings.TrimSuffix(string(line), "\r")
+	matched := strings.HasPrefix(firstLine, marker)
+	if source.options.ContentMarkerFold {
+		fold := func(str string) string { return strings.ToLower(strings.Join(strings.Fields(str), " ")) }
+		matched = strings.HasPrefix(fold(firstLine), fold(marker))
+	}
+	if !matched {
+		return fmt.Errorf("Content marker mismatch: the content starts with [%.64s], expected [%s]", firstLine, marker)
+	}
+	return nil
+}
+
+type sourceDownload struct {
+	url          *url.URL
+	bin, sig, in []byte
+	header       http.Header
+	timestamp    time.Time
+}
+
+// fetchWithCache must not run concurrently for the same source: a second caller waits for the first one,
+// and then finds the freshly written cache instead of downloading the source again.
+func (source *Source) fetchWithCache(ctx context.Context, xTransport *XTransport, now time.Time) (delay time.Duration, err error) {
+	source.refreshLock.Lock()
+	defer source.refreshLock.Unlock()
+	defer source.snapshotStatus()
+	defer func() {
+		source.lastRefresh, source.lastError = now, ""
+		if err != nil {
+			source.lastError = err.Error()
+		}
+	}()
+	delay, err = source.fetchFromCache(ctx, xTransport, now)
+	source.updateCacheStats(func(stats *SourceCacheStats) {
+		if err == nil && delay > 0 {
+			stats.CacheHits++
+		} else {
+			stats.CacheMisses++
+		}
+	})
+	if err != nil {
+		if source.options.Offline {
+			dlog.Errorf("Source [%s] cache file [%s] not present, and the source is in offline mode", source.name, source.cacheFile)
+			return
+		}
+		if len(source.urls) == 0 {
+			dlog.Errorf("Source [%s] cache file [%s] not present and no valid URL", source.name, source.cacheFile)
+			return
+		}
+		dlog.Debugf("Source [%s] cache file [%s] not present", source.name, source.cacheFile)
+	}
+	if source.options.Offline {
+		if delay <= 0 {
+			dlog.Noticef("Source [%s] is in offline mode, using the expired cache file [%s]", source.name, source.cacheFile)
+		}
+		return
+	}
+	if len(source.urls) > 0 {
+		defer func() {
+			source.refresh = now.Add(delay)
+		}()
+	}
+	if len(source.urls) == 0 || delay > 0 {
+		return
+	}
+	delay = MinimumPrefetchInterval
+	urls := source.urls
+	if source.breakerTripped() {
+		if now.Before(source.breakerUntil) {
+			delay = source.breakerUntil.Sub(now)
+			dlog.Warnf("Source [%s] updates are suspended until %v after %d consecutive verification failures", source.name, source.breakerUntil, source.verifyFailures)
+			return
+		}
+		dlog.Noticef("Source [%s] probing URL [%s] after %d consecutive verification failures", source.name, redactedURL(urls[0]), source.verifyFailures)
+		urls = urls[:1]
+	}
+	source.updateCacheStats(func(stats *SourceCacheStats) { stats.NetworkFetches++ })
+	if len(source.options.KeyManifestURL) > 0 && !source.lastRefresh.IsZero() { // newSource just loaded it otherwise
+		source.refreshKeyManifest(ctx, xTransport)
+	}
+	fetchCtx, budget := ctx, source.refreshBudget()
+	if budget > 0 {
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+	}
+	var bin, sig, in []byte
+	var respHeader http.Header
+	var loadedURL *url.URL
+	var newest *sourceDownload // with PreferNewest, the valid download with the most recent signature
+	verifyFailed := false
+	unchanged := false // with SignatureFirst, the signature at loadedURL is identical to the cached one, or its Git commit is the cached one
+	for _, i := range source.mirrorOrder(len(urls)) {
+		srcURL := urls[i]
+		var checksums checksumManifest // with ChecksumManifest, the hashes of the files at srcURL
+		if fetchCtx.Err() != nil && ctx.Err() == nil {
+			dlog.Warnf("Source [%s] refresh budget of %v exhausted, URL [%s] and the next ones are not tried", source.name, budget, redactedURL(srcURL))
+			err = fmt.Errorf("Source [%s] refresh budget of %v exhausted", source.name, budget)
+			break
+		}
+		dlog.Infof("Source [%s] loading from URL [%s]", source.name, redactedURL(srcURL))
+		sigURL, sigFetched, sigReused := srcURL, false, false
+		var sigErr error // error downloading the signature, which is only tried once for each URL
+		respHeader = nil
+		if isGitURL(srcURL) {
+			cachedCommit := ""
+			if !source.options.PreferNewest {
+				cachedCommit = source.cachedCommit()
+			}
+			if bin, sig, srcURL, err = source.fetchFromGit(fetchCtx, srcURL, cachedCommit); err != nil {
+				dlog.Debugf("Source [%s] failed to load from Git URL [%s]: %v", source.name, redactedURL(sigURL), err)
+				continue
+			}
+			if bin == nil {
+				loadedURL, unchanged = srcURL, true
+				break
+			}
+			sigURL, sigFetched = srcURL, true
+		} else {
+			if source.options.ChecksumManifest && !source.options.Bundle {
+				if checksums, err = source.fetchChecksumManifest(fetchCtx, xTransport, srcURL); err != nil {
+					dlog.Debugf("Source [%s] URL [%s] rejected: %v", source.name, redactedURL(srcURL), err)
+					continue
+				}
+			}
+			if source.options.SignatureFirst && !source.options.Bundle {
+				sig, sigURL, sigErr = source.fetchSignature(fetchCtx, xTransport, srcURL, source.contentSigURL(i, srcURL))
+				if sigErr == nil {
+					sigFetched = true
+					if !source.options.PreferNewest && source.signatureUnchanged(sig) {
+						verifyErr := source.checkSignature(source.rawContent(), sig)
+						if verifyErr == nil {
+							dlog.Infof("Source [%s] signature from URL [%s] is unchanged, the content is not downloaded again", source.name, redactedURL(sigURL))
+							loadedURL, unchanged = srcURL, true
+							break
+						}
+						dlog.Warnf("Source [%s] signature from URL [%s] is unchanged, but no longer valid: %v", source.name, redactedURL(sigURL), verifyErr)
+					}
+				} else if !source.options.ReuseCachedSignature && len(source.options.SignatureSchemes) == 0 {
+					err = sigErr
+					continue
+				}
+			}
+			fetchStart := time.Now()
+			bin, respHeader, err = source.fetchURL(fetchCtx, xTransport, "GET", srcURL, source.acceptHeader())
+			source.recordMirrorFetch(srcURL, time.Since(fetchStart), err)
+			if err != nil {
+				dlog.Debugf("Source [%s] failed to download from URL [%s]", source.name, redactedURL(srcURL))
+				continue
+			}
+			if source.options.Bundle {
+				if bin, sig, err = splitSignatureBundle(bin); err != nil {
+					dlog.Debugf("Source [%s] download from URL [%s] rejected: %v", source.name, redactedURL(srcURL), err)
+					continue
+				}
+				sigFetched = true
+			} else if !sigFetched {
+				sigURL = source.contentSigURL(i, srcURL)
+			}
+			if checksums != nil {
+				contentName, _ := source.checksumNames(srcURL)
+				if err = checksums.check(contentName, bin); err != nil {
+					dlog.Warnf("Source [%s] content from URL [%s] rejected: %v", source.name, redactedURL(srcURL), err)
+					continue
+				}
+			}
+		}
+		if err = source.checkDownloadSize(bin); err != nil {
+			dlog.Debugf("Source [%s] download from URL [%s] rejected: %v", source.name, redactedURL(srcURL), err)
+			continue
+		}
+		if err = source.checkContentMarker(bin); err != nil {
+			dlog.Warnf("Source [%s] download from URL [%s] rejected: %v", source.name, redactedURL(srcURL), err)
+			continue
+		}
+		if !sigFetched && sigErr == nil && source.options.SignatureDelay > 0 {
+			dlog.Debugf("Source [%s] waiting %v before downloading the signature of URL [%s]", source.name, source.options.SignatureDelay, redactedURL(srcURL))
+			select {
+			case <-fetchCtx.Done():
+				err = fetchCtx.Err()
+				continue
+			case <-time.After(source.options.SignatureDelay):
+			}
+		}
+		if !sigFetched {
+			if sigErr == nil {
+				sig, sigURL, sigErr = source.fetchSignature(fetchCtx, xTransport, srcURL, sigURL)
+			}
+			if err = sigErr; err != nil {
+				if schemeSig, schemeURL := source.schemeSignature(fetchCtx, xTransport, srcURL, bin); schemeSig != nil {
+					sig, sigURL, err = schemeSig, schemeURL, nil
+				} else if sig = source.reusableSignature(bin); sig == nil {
+					continue
+				} else {
+					dlog.Noticef("Source [%s] signature couldn't be downloaded from URL [%s], but the content is identical to the verified cached copy", source.name, redactedURL(sigURL))
+					err = nil
+					sigReused = true
+				}
+			}
+		}
+		if checksums != nil && !sigReused {
+			_, sigName := source.checksumNames(srcURL)
+			if err = checksums.check(sigName, sig); err != nil {
+				dlog.Warnf("Source [%s] signature from URL [%s] rejected: %v", source.name, redactedURL(sigURL), err)
+				continue
+			}
+		}
+		if err = source.checkSignature(bin, sig); err != nil {
+			schemeSig, schemeURL := source.schemeSignature(fetchCtx, xTransport, srcURL, bin)
+			if schemeSig == nil {
+				dlog.Debugf("Source [%s] failed signature check using URL [%s]", source.name, redactedURL(srcURL))
+				verifyFailed = true
+				continue
+			}
+			sig, sigURL, err = schemeSig, schemeURL, nil
+		}
+		var timestamp time.Time
+		if timestamp, err = source.signedTimestamp(sig); err != nil {
+			dlog.Warnf("Source [%s] signature from URL [%s] rejected: %v", source.name, redactedURL(sigURL), err)
+			continue
+		}
+		dlog.Debugf("Source [%s] signature loaded from URL [%s]", source.name, redactedURL(sigURL))
+		if in, err = source.transformContent(bin); err != nil {
+			dlog.Debugf("Source [%s] download from URL [%s] rejected: %v", source.name, redactedURL(srcURL), err)
+			continue
+		}
+		if source.options.OnParseFailure == ParseFailureRefresh {
+			if err = source.checkParsableAs(source.negotiatedFormatStr(respHeader), in); err != nil {
+				dlog.Warnf("Source [%s] content from URL [%s] has a valid signature but can't be parsed: %v", source.name, redactedURL(srcURL), err)
+				continue
+			}
+		}
+		if !source.options.PreferNewest {
+			loadedURL = srcURL
+			break // valid signature and content
+		}
+		if timestamp.IsZero() {
+			dlog.Debugf("Source [%s] signature from URL [%s] has no timestamp", source.name, redactedURL(sigURL))
+		}
+		if newest == nil || timestamp.After(newest.timestamp) {
+			newest = &sourceDownload{url: srcURL, bin: bin, sig: sig, in: in, header: respHeader, timestamp: timestamp}
+		} else {
+			dlog.Debugf("Source [%s] content from URL [%s] is not newer than the one from URL [%s]", source.name, redactedURL(srcURL), redactedURL(newest.url))
+		}
+	}
+	if unchanged {
+		source.verifyFailures = 0
+		source.stale = false
+		source.writeToCache(ctx, source.rawContent(), sig, now) // only updates the modification time of the cache file
+		source.lastSuccessfulURL = redactedURL(loadedURL)
+		delay = source.scheduledDelay(now, now)
+		return
+	}
+	if newest != nil {
+		loadedURL, bin, sig, in, respHeader, err = newest.url, newest.bin, newest.sig, newest.in, newest.header, nil
+		dlog.Debugf("Source [%s] using the newest content, from URL [%s]", source.name, redactedURL(loadedURL))
+	}
+	if err != nil {
+		if verifyFailed {
+			source.recordVerifyFailure(now, &delay)
+		}
+		return
+	}
+	source.verifyFailures = 0
+	if err = source.checkPin(bin); err != nil {
+		dlog.Warnf("Source [%s] update from URL [%s] rejected: %v - Keeping the pinned content", source.name, redactedURL(loadedURL), err)
+		delay = source.scheduledDelay(now, now)
+		return
+	}
+	if err = source.checkReload(source.negotiatedFormatStr(respHeader), in); err != nil {
+		delay = source.scheduledDelay(now, now)
+		return
+	}
+	if err = source.approveUpdate(ctx, loadedURL, bin); err != nil {
+		delay = source.scheduledDelay(now, now)
+		return
+	}
+	source.stale = false
+	source.writeToCache(ctx, bin, sig, now)
+	if err = source.recordNegotiatedFormat(source.negotiatedFormatStr(respHeader)); err != nil {
+		dlog.Warnf("Source [%s] format of the content from URL [%s] can't be recorded in the cache: %v", source.name, redactedURL(loadedURL), err)
+		err = nil
+	}
+	if err = source.recordCommit(loadedURL); err != nil {
+		dlog.Warnf("Source [%s] commit of the content from URL [%s] can't be recorded in the cache: %v", source.name, redactedURL(loadedURL), err)
+		err = nil
+	}
+	source.setContent(bin, in)
+	source.lastSuccessfulURL = redactedURL(loadedURL)
+	source.applyCacheControl(respHeader, now)
+	delay = source.scheduledDelay(now, now)
+	return
+}
+
+func (source *Source) refreshBudget() time.Duration {
+	if source.options.RefreshBudget == 0 {
+		return DefaultRefreshBudget
+	}
+	return source.options.RefreshBudget
+}
+
+// mirrorOrder returns the indexes of the first n URLs in the order they are tried:
+// starting with one picked at random according to their weights, if any, and wrapping around
+func (source *Source) mirrorOrder(n int) []int {
+	start := 0
+	if n > 1 && len(source.weights) >= n {
+		start = source.pickMirror(source.weights[:n])
+	}
+	order := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		order = append(order, (start+i)%n)
+	}
+	return order
+}
+
+// mirrorRandLock guards the MirrorRand of all sources, since a *rand.Rand is not safe for concurrent use,
+// and the same one can be set for several sources that are refreshed concurrently
+var mirrorRandLock sync.Mutex
+
+func (source *Source) pickMirror(weights []int) int {
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	if total <= 0 {
+		return 0
+	}
+	var r int
+	if source.options.MirrorRand != nil {
+		mirrorRandLock.Lock()
+		r = source.options.MirrorRand.Intn(total)
+		mirrorRandLock.Unlock()
+	} else {
+		r = rand.Intn(total)
+	}
+	for i, weight := range weights {
+		if r < weight {
+			return i
+		}
+		r -= weight
+	}
+	return 0
+}
+
+func (source *Source) breakerTripped() bool {
+	return source.options.BreakerThreshold > 0 && source.verifyFailures >= source.options.BreakerThreshold
+}
+
+func (source *Source) recordVerifyFailure(now time.Time, delay *time.Duration) {
+	if source.options.BreakerThreshold <= 0 {
+		return
+	}
+	source.verifyFailures++
+	if !source.breakerTripped() {
+		return
+	}
+	cooldown := source.options.BreakerCooldown
+	if cooldown <= 0 {
+		cooldown = DefaultBreakerCooldown
+	}
+	source.breakerUntil = now.Add(cooldown)
+	*delay = cooldown
+	dlog.Criticalf("Source [%s] failed signature verification %d times in a row - It may be broken or compromised, updates are suspended for %v", source.name, source.verifyFailures, cooldown)
+}
+
+// checkPinnedKeys compares the IDs of the keys of the source with the ones recorded in its metadata
+func (source *Source) checkPinnedKeys() error {
+	keyIDs := make([]string, 0, len(source.minisignKeys))
+	for _, key := range source.minisignKeys {
+		keyIDs = append(keyIDs, key.id)
+	}
+	sort.Strings(keyIDs)
+	meta, err := source.readMetadata()
+	if err != nil {
+		return err
+	}
+	if len(meta.KeyIDs) > 0 {
+		if strings.Join(meta.KeyIDs, ",") == strings.Join(keyIDs, ",") {
+			return nil
+		}
+		if !source.options.AcceptKeyChange {
+			return fmt.Errorf("Keys of source [%s] changed from [%s] to [%s] - If this is intentional, confirm the change with `accept_key_change = true`",
+				source.name, strings.Join(meta.KeyIDs, ", "), strings.Join(keyIDs, ", "))
+		}
+		dlog.Warnf("Keys of source [%s] changed from [%s] to [%s]", source.name, strings.Join(meta.KeyIDs, ", "), strings.Join(keyIDs, ", "))
+	} else {
+		dlog.Noticef("Source [%s] keys pinned: [%s]", source.name, strings.Join(keyIDs, ", "))
+	}
+	meta.KeyIDs = keyIDs
+	return source.writeMetadata(meta)
+}
+
+// SetURLs replaces the URLs of the source and the URLs of their signatures, keeping its content, its cache and its refresh schedule.
+// sigURLs replace SignatureURLs, and must match urls if set: if empty, the signatures are downloaded from urls with the suffix added.
+// Unlike NewSource, which skips URLs that can't be parsed, SetURLs returns an error and keeps the current URLs if any of them is invalid.
+func (source *Source) SetURLs(urls, sigURLs []string) error {
+	configSigURLs := sigURLs
+	urls, sigURLs, err := source.prepareURLs(urls, sigURLs)
+	if err != nil {
+		return err
+	}
+	for i, urlStr := range urls {
+		if _, err := url.Parse(urlStr); err != nil {
+			return fmt.Errorf("Invalid URL [%s] for source [%s]: %v", redactURL(urlStr), source.name, redactURLError(err))
+		}
+		if len(sigURLs) > 0 {
+			if _, err := url.Parse(sigURLs[i]); err != nil {
+				return fmt.Errorf("Invalid signature URL [%s] for source [%s]: %v", redactURL(sigURLs[i]), source.name, redactURLError(err))
+			}
+		}
+	}
+	parsed := &Source{name: source.name, urls: []*url.URL{}, options: source.options}
+	if err := parsed.parseURLs(urls, sigURLs); err != nil {
+		return err
+	}
+	source.refreshLock.Lock()
+	previous := source.urls
+	source.urls, source.sigURLs, source.weights, source.credentials = parsed.urls, parsed.sigURLs, parsed.weights, parsed.credentials
+	source.options.SignatureURLs = configSigURLs
+	source.snapshotStatus()
+	source.refreshLock.Unlock()
+	source.pruneMirrors(parsed.urls)
+	dlog.Noticef("Source [%s] URLs changed from %v to %v", source.name, redactedURLs(previous), redactedURLs(parsed.urls))
+	return nil
+}
+
+// LastSuccessfulURL returns the URL the current content was downloaded from, or an empty string if it was loaded from the cache
+func (source *Source) LastSuccessfulURL() string {
+	return source.snapshot().lastSuccessfulURL
+}
+
+// NewSource loads a new source using the given cacheFile and urls, ensuring it has a valid signature made with one of the keys
+func NewSource(name string, xTransport *XTransport, urls []string, minisignKeyStrs []string, cacheFile string, formatStr string, refreshDelay time.Duration, options SourceOptions) (*Source, error) {
+	return newSource(context.Background(), name, xTransport, urls, minisignKeyStrs, cacheFile, formatStr, refreshDelay, options)
+}
+
+func newSource(ctx context.Context, name string, xTransport *XTransport, urls []string, minisignKeyStrs []string, cacheFile string, formatStr string, refreshDelay time.Duration, options SourceOptions) (source *Source, err error) {
+	if refreshDelay < DefaultPrefetchDelay {
+		refreshDelay = DefaultPrefetchDelay
+	}
+	source = &Source{name: name, urls: []*url.URL{}, cacheFile: cacheFile, cacheTTL: refreshDelay, prefetchDelay: DefaultPrefetchDelay, options: options}
+	var sigURLs []string
+	if urls, sigURLs, err = source.prepareURLs(urls, options.SignatureURLs); err != nil {
+		return
+	}
+	if options.ExpandEnv {
+		if source.cacheFile, err = source.expandEnv("cache file", cacheFile); err != nil {
+			source.cacheFile = cacheFile
+			return
+		}
+	}
+	if source.format, err = parseSourceFormat(formatStr); err != nil {
+		return
+	}
+	if err = source.applyFreshnessJitter(); err != nil {
+		return
+	}
+	if err = source.checkAcceptFormats(); err != nil {
+		return
+	}
+	if options.MaxBandwidth > 0 {
+		source.bandwidth = NewBandwidthLimiter(options.MaxBandwidth)
+	}
+	if len(options.PinnedHash) > 0 {
+		if err = source.Pin(options.PinnedHash); err != nil {
+			return
+		}
+	}
+	for _, minisignKeyStr := range minisignKeyStrs {
+		key, err := parseSourceKey(minisignKeyStr)
+		if err != nil {
+			return source, err
+		}
+		source.minisignKeys = append(source.minisignKeys, key)
+	}
+	for _, overrideKeyStr := range options.OverrideKeys {
+		key, err := parseSourceKey(overrideKeyStr)
+		if err != nil {
+			return source, fmt.Errorf("Invalid Minisign key for the overrides of source [%s]: %v", name, err)
+		}
+		source.overrideKeys = append(source.overrideKeys, key)
+	}
+	source.cacheFile = deriveCacheFile(source.cacheFile, source.minisignKeys, options)
+	if len(options.Resolvers) > 0 {
+		if source.resolver, err = xTransport.newSourceResolver(options.Resolvers); err != nil {
+			return
+		}
+	}
+	if len(options.KeyManifestURL) > 0 {
+		source.configKeys = len(source.minisignKeys)
+		var keys []sourceKey
+		if keys, err = source.loadKeyManifest(ctx, xTransport); err != nil {
+			return
+		}
+		source.minisignKeys = append(source.minisignKeys, keys...)
+	}
+	if len(source.minisignKeys) == 0 {
+		return source, fmt.Errorf("No Minisign key for source [%s]", name)
+	}
+	if options.ServerNamesOnly && options.OnParseFailure == ParseFailureKeepLastGood {
+		return source, fmt.Errorf("Source [%s] can't only retain the names of its servers if it keeps them on parse failures", name)
+	}
+	if err = checkSignatureSuffix(options.SignatureSuffix); err != nil {
+		return source, fmt.Errorf("Source [%s] %v", name, err)
+	}
+	for _, statusCode := range options.AcceptedStatusCodes {
+		if statusCode < 200 || statusCode > 299 {
+			return source, fmt.Errorf("Source [%s] can't accept status code [%d], only 2xx status codes are successful downloads", name, statusCode)
+		}
+	}
+	if options.PinKeys {
+		if err = source.checkPinnedKeys(); err != nil {
+			return
+		}
+	}
+	if source.verifyCache, err = newVerifyCache(options.VerifyCacheSize); err != nil {
+		return
+	}
+	if err = source.parseURLs(urls, sigURLs); err != nil {
+		return
+	}
+	if options.NoCacheSignature && (options.Offline || len(source.urls) == 0) {
+		return source, fmt.Errorf("Source [%s] doesn't cache signatures, and can't download them to verify its cached copy", name)
+	}
+	if options.Offline {
+		dlog.Noticef("Source [%s] is in offline mode, its URLs won't be contacted", name)
+	}
+	now := timeNow()
+	if source.seedCache(ctx, now) && !options.Offline && len(source.urls) > 0 {
+		source.refresh = now // downloaded by the next PrefetchSources
+		source.snapshotStatus()
+		dlog.Noticef("Source [%s] loaded from its bundled copy, and will be updated in the background", name)
+		return
+	}
+	if _, err = source.fetchWithCache(ctx, xTransport, now); err == nil {
+		dlog.Noticef("Source [%s] loaded", name)
+	}
+	return
+}
+
+// Refresh updates the source if its cached copy has expired, waiting for any refresh already in progress
+func (source *Source) Refresh(ctx context.Context, xTransport *XTransport) (time.Duration, error) {
+	return source.fetchWithCache(ctx, xTransport, timeNow())
+}
+
+// PrefetchSources downloads latest versions of given sources, ensuring they have a valid signature before caching
+func PrefetchSources(xTransport *XTransport, sources []*Source) time.Duration {
+	interval, _ := PrefetchSourcesDetailed(context.Background(), xTransport, sources)
+	return interval
+}
+
+// PrefetchSourcesDetailed is PrefetchSources, also returning when each source is due next, in the order of sources,
+// so that the caller can schedule each source instead of waking up at the returned interval. Canceling ctx aborts the downloads
+// and the cache writes in progress, leaving the cached copies as they were.
+func PrefetchSourcesDetailed(ctx context.Context, xTransport *XTransport, sources []*Source) (time.Duration, []SourcePrefetch) {
+	now := timeNow()
+	interval := MinimumPrefetchInterval
+	results := make([]SourcePrefetch, len(sources))
+	for i, source := range sources {
+		results[i].Source = source.name
+		status := source.snapshot()
+		switch {
+		case source.options.Offline:
+			source.traceSchedule(false, "skipped: offline")
+			continue
+		case status.refresh.IsZero():
+			source.traceSchedule(false, "skipped: no URL to refresh the source from")
+			continue
+		case status.refresh.After(now):
+			source.traceSchedule(false, "not due: next at %v", status.refresh)
+			results[i].NextRefresh = status.nextDue()
+			continue
+		case now.Before(status.suspendedUntil):
+			source.traceSchedule(true, "run: due, but updates are suspended until %v after %d verification failures", status.suspendedUntil, status.verifyFailures)
+		case status.refresh.Before(now):
+			source.traceSchedule(true, "run: overdue since %v", status.refresh)
+		default:
+			source.traceSchedule(true, "run: due")
+		}
+		dlog.Debugf("Prefetching [%s]", source.name)
+		delay, err := source.fetchWithCache(ctx, xTransport, now)
+		results[i].Ran, results[i].Err, results[i].NextRefresh = true, err, source.snapshot().nextDue()
+		if err != nil {
+			dlog.Infof("Prefetching [%s] failed: %v", source.name, err)
+		} else {
+			dlog.Debugf("Prefetching [%s] succeeded, next update: %v", source.name, delay)
+			if delay >= MinimumPrefetchInterval && (interval == MinimumPrefetchInterval || interval > delay) {
+				interval = delay
+			}
+		}
+	}
+	return interval, results
+}
+
+// NextWakeTime returns when the first of the given sources is due to be refreshed by PrefetchSources, or now if one is already due.
+// Sources that are never refreshed, such as offline sources and sources without URLs, are skipped, and the zero time is returned if no source
+// will ever be due. Sources whose updates are suspended by the circuit breaker are due at the end of the cooldown.
+func NextWakeTime(sources []*Source, now time.Time) time.Time {
+	var next time.Time
+	for _, source := range sources {
+		status := source.snapshot()
+		if source.options.Offline || status.refresh.IsZero() {
+			continue
+		}
+		due := status.nextDue()
+		if due.Before(now) {
+			due = now
+		}
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return next
+}
+
+// ParseFailurePolicy tells what to do when the verified content of a source can't be parsed,
+// for example because it uses a format this version doesn't understand
+type ParseFailurePolicy int
+
+const (
+	ParseFailureFail         ParseFailurePolicy = iota // Parse returns the error, and the servers it parses are not retained
+	ParseFailureKeepLastGood                           // Parse keeps returning the servers it last parsed successfully, if any
+	ParseFailureRefresh                                // the content is rejected like an invalid one, and the source is downloaded again
+)
+
+func parseParseFailurePolicy(str string) (ParseFailurePolicy, error) {
+	switch strings.ToLower(str) {
+	case "", "fail":
+		return ParseFailureFail, nil
+	case "keep":
+		return ParseFailureKeepLastGood, nil
+	case "refresh":
+		return ParseFailureRefresh, nil
+	}
+	return ParseFailureFail, fmt.Errorf("Unsupported parse failure policy: [%s]", str)
+}
+
+// SourceRole is the kind of servers a source is declared to list
+type SourceRole int
+
+const (
+	SourceRoleMixed     SourceRole = iota // resolvers and relays are accepted
+	SourceRoleResolvers                   // relay stamps are rejected
+	SourceRoleRelays                      // only relay stamps are accepted
+)
+
+func parseSourceRole(str string) (SourceRole, error) {
+	switch strings.ToLower(str) {
+	case "", "mixed":
+		return SourceRoleMixed, nil
+	case "resolvers":
+		return SourceRoleResolvers, nil
+	case "relays":
+		return SourceRoleRelays, nil
+	}
+	return SourceRoleMixed, fmt.Errorf("Unsupported source role: [%s]", str)
+}
+
+func (role SourceRole) String() string {
+	switch role {
+	case SourceRoleResolvers:
+		return "resolvers"
+	case SourceRoleRelays:
+		return "relays"
+	}
+	return "mixed"
+}
+
+// checkRole returns an error if the protocol of stamp doesn't match the declared role of the source
+func (source *Source) checkRole(stamp stamps.ServerStamp) error {
+	isRelay := stamp.Proto == stamps.StampProtoTypeDNSCryptRelay
+	switch source.options.Role {
+	case SourceRoleResolvers:
+		if isRelay {
+			return fmt.Errorf("relay stamp in a source of resolvers")
+		}
+	case SourceRoleRelays:
+		if !isRelay {
+			return fmt.Errorf("%s stamp in a source of relays", stamp.Proto.String())
+		}
+	}
+	return nil
+}
+
+// checkParsable returns an error if bin can't be split into entries, without decoding their stamps
+func (source *Source) checkParsable(bin []byte) error {
+	return source.checkParsableAs(source.negotiatedFormat, bin)
+}
+
+// checkParsableAs checks that content whose format was negotiated as formatStr can be parsed, see negotiatedFormatStr.
+// Archives are checked by extracting them, and parsing their entries.
+func (source *Source) checkParsableAs(formatStr string, bin []byte) error {
+	if source.options.Archive {
+		return source.checkArchiveParsable(bin)
+	}
+	format, err := source.contentFormatAs(formatStr, bin)
+	if err != nil {
+		return err
+	}
+	_, err = source.scanEntries(format, bin, "")
+	return err
+}
+
+func (source *Source) Parse(prefix string) (_ []RegisteredServer, err error) {
+	endSpan := source.startSpan("source.parse", nil)
+	defer func() { endSpan(err) }()
+	registeredServers, err := source.parse(source.in, prefix)
+	source.statsLock.Lock()
+	defer source.statsLock.Unlock()
+	if err == nil {
+		source.parseError = ""
+		source.serverNames = make([]string, 0, len(registeredServers))
+		for _, registeredServer := range registeredServers {
+			source.serverNames = append(source.serverNames, registeredServer.name)
+		}
+		if source.options.OnParseFailure == ParseFailureKeepLastGood {
+			source.lastGood, source.lastGoodPrefix = registeredServers, prefix
+		}
+		return registeredServers, nil
+	}
+	source.parseError = err.Error()
+	if len(registeredServers) == 0 && len(source.lastGood) > 0 && source.lastGoodPrefix == prefix &&
+		source.options.OnParseFailure == ParseFailureKeepLastGood {
+		dlog.Warnf("Source [%s] can't be parsed, keeping the %d servers previously parsed: %v", source.name, len(source.lastGood), err)
+		return source.lastGood, nil
+	}
+	return registeredServers, err
+}
+
+// ParseError returns the error of the last Parse, or nil if it succeeded. With ParseFailureKeepLastGood, Parse doesn't
+// return errors if it can return the servers it previously parsed, and ParseError tells if they are outdated.
+func (source *Source) ParseError() error {
+	source.statsLock.Lock()
+	defer source.statsLock.Unlock()
+	if len(source.parseError) == 0 {
+		return nil
+	}
+	return errors.New(source.parseError)
+}
+
+// ServerNames returns the names of the servers returned by the last Parse, without parsing the content again.
+// Nil is returned if the source hasn't been parsed since its content was loaded or changed.
+func (source *Source) ServerNames() []string {
+	source.statsLock.Lock()
+	defer source.statsLock.Unlock()
+	if source.serverNames == nil {
+		return nil
+	}
+	return append([]string{}, source.serverNames...)
+}
+
+// readAllLimited reads r until EOF, rejecting what is read if it is larger than MaxHTTPBodyLength
+func readAllLimited(r io.Reader, what string) ([]byte, error) {
+	bin, err := ioutil.ReadAll(io.LimitReader(r, MaxHTTPBodyLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(bin) > MaxHTTPBodyLength {
+		return nil, fmt.Errorf("%s is larger than %d bytes", what, MaxHTTPBodyLength)
+	}
+	return bin, nil
+}
+
+// ParseReader verifies and parses content read from r, without fetching nor caching anything.
+// The content is verified using the keys of the source, unless sigReader is nil.
+func (source *Source) ParseReader(r io.Reader, sigReader io.Reader, prefix string) ([]RegisteredServer, error) {
+	bin, err := readAllLimited(r, "Content")
+	if err != nil {
+		return []RegisteredServer{}, err
+	}
+	if sigReader != nil {
+		sig, err := readAllLimited(sigReader, "Signature")
+		if err != nil {
+			return []RegisteredServer{}, err
+		}
+		if err = source.checkSignature(bin, sig); err != nil {
+			return []RegisteredServer{}, err
+		}
+		if _, err = source.signedTimestamp(sig); err != nil {
+			return []RegisteredServer{}, err
+		}
+	}
+	if bin, err = source.transformContent(bin); err != nil {
+		return []RegisteredServer{}, err
+	}
+	return source.parse(bin, prefix)
+}
+
+// ProtoDistribution returns the number of servers using each protocol
+func ProtoDistribution(registeredServers []RegisteredServer) map[stamps.StampProtoType]int {
+	distribution := make(map[stamps.StampProtoType]int)
+	for _, registeredServer := range registeredServers {
+		distribution[registeredServer.stamp.Proto]++
+	}
+	return distribution
+}
+
+func formatProtoDistribution(distribution map[stamps.StampProtoType]int) string {
+	protos := make([]stamps.StampProtoType, 0, len(distribution))
+	for proto := range distribution {
+		protos = append(protos, proto)
+	}
+	sort.Slice(protos, func(i, j int) bool { return protos[i] < protos[j] })
+	counts := make([]string, 0, len(protos))
+	for _, proto := range protos {
+		counts = append(counts, fmt.Sprintf("%s: %d", proto.String(), distribution[proto]))
+	}
+	return strings.Join(counts, ", ")
+}
+
+// contentFormat returns the format of bin, which can override the configured one with a "format" directive
+func (source *Source) contentFormat(bin []byte) (SourceFormat, error) {
+	return source.contentFormatAs(source.negotiatedFormat, bin)
+}
+
+func (source *Source) contentFormatAs(negotiatedFormatStr string, bin []byte) (SourceFormat, error) {
+	if baseFormat := source.formatOf(negotiatedFormatStr); baseFormat != SourceFormatV2 {
+		return baseFormat, nil
+	}
+	formatStr, ok := parseV2Directives(string(bin))["format"]
+	if !ok {
+		return SourceFormatV2, nil
+	}
+	format, err := parseSourceFormat(formatStr)
+	if err != nil {
+		return format, fmt.Errorf("Source [%s] requires format [%s], which is not supported by this version", source.name, formatStr)
+	}
+	return format, nil
+}
+
+func (source *Source) parse(bin []byte, prefix string) ([]RegisteredServer, error) {
+	format, err := source.contentFormat(bin)
+	if err != nil {
+		return []RegisteredServer{}, err
+	}
+	entries, err := source.scanEntries(format, bin, prefix)
+	registeredServers, err := source.registerEntries(entries, err)
+	var overrideErr error
+	if registeredServers, overrideErr = source.applyOverrides(registeredServers, prefix); overrideErr != nil {
+		return registeredServers, overrideErr
+	}
+	registeredServers = source.dedupServers(registeredServers)
+	if err == nil {
+		dlog.Debugf("Source [%s] servers by protocol: [%s]", source.name, formatProtoDistribution(ProtoDistribution(registeredServers)))
+	}
+	if source.options.SortServers {
+		sort.SliceStable(registeredServers, func(i, j int) bool {
+			return registeredServers[i].name < registeredServers[j].name
+		})
+	}
+	return registeredServers, err
+}
+
+// parseV2Directives returns the directives ("## .name value") present before the first entry of a V2 source,
+// without reading the rest of it
+func parseV2Directives(in string) map[string]string {
+	directives := make(map[string]string)
+	for idx := strings.Index(in, "## "); idx >= 0; {
+		in = in[idx+3:]
+		if !strings.HasPrefix(in, ".") {
+			break
+		}
+		part := in
+		if idx = strings.Index(in, "## "); idx >= 0 {
+			part = in[:idx]
+		}
+		line := strings.TrimFunc(strings.SplitN(part, "\n", 2)[0], unicode.IsSpace)
+		fields := strings.Fields(line[1:])
+		if len(fields) == 0 {
+			continue
+		}
+		directives[fields[0]] = strings.Join(fields[1:], " ")
+	}
+	return directives
+}
+
+// SourceHeader holds the directives of a V2 source
+type SourceHeader struct {
+	Format          string            // "format": the format the entries use, if not the configured one
+	SignatureSuffix string            // "signature_suffix": the suffix of the URLs of the signatures
+	MinServers      int               // "min_servers": the minimum number of servers the source is expected to list
+	Unknown         map[string]string // other directives, by name
+}
+
+// ParseHeader returns the directives of the source, without parsing its entries.
+// Sources in other formats than V2 have no directives.
+func (source *Source) ParseHeader() (SourceHeader, error) {
+	header := SourceHeader{Unknown: make(map[string]string)}
+	if source.formatOf(source.negotiatedFormat) != SourceFormatV2 {
+		return header, nil
+	}
+	for name, value := range parseV2Directives(string(source.in)) {
+		switch name {
+		case "format":
+			header.Format = value
+		case "signature_suffix":
+			header.SignatureSuffix = value
+		case "min_servers":
+			minServers, err := strconv.Atoi(value)
+			if err != nil || minServers < 0 {
+				return header, fmt.Errorf("Source [%s] has an invalid min_servers directive: [%s]", source.name, value)
+			}
+			header.MinServers = minServers
+		default:
+			header.Unknown[name] = value
+		}
+	}
+	return header, nil
+}
+
+// NameNormalization is applied to the names of the servers of a source
+type NameNormalization int
+
+const (
+	NameNormalizationNone NameNormalization = iota // names are kept as-is, but rejected if they contain control characters
+	NameNormalizationNFC                           // percent-encoded characters are decoded, and names are normalized to Unicode NFC
+)
+
+func parseNameNormalization(str string) (NameNormalization, error) {
+	switch strings.ToLower(str) {
+	case "", "none":
+		return NameNormalizationNone, nil
+	case "nfc":
+		return NameNormalizationNFC, nil
+	}
+	return NameNormalizationNone, fmt.Errorf("Unsupported name normalization: [%s]", str)
+}
+
+// normalizeName applies the name normalization of the source, and rejects names with control or invisible formatting
+// characters, which could make different entries look identical
+func (source *Source) normalizeName(name string) (string, error) {
+	if source.options.NameNormalization == NameNormalizationNFC {
+		if unescaped, err := url.PathUnescape(name); err == nil {
+			name = unescaped
+		}
+		name = norm.NFC.String(name)
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) || unicode.Is(unicode.Cf, c) {
+			return name, fmt.Errorf("Invalid character %U in server name [%q]", c, name)
+		}
+	}
+	return name, nil
+}
+
+// ServerFilter tells if a server of a source, given its name including the prefix, must be kept
+type ServerFilter func(name string) bool
+
+// NewServerFilter returns a filter keeping the servers whose name matches one of the include patterns, if there are any,
+// and none of the exclude patterns. Patterns use the syntax of path.Match. The filter is nil if there are no patterns.
+func NewServerFilter(include, exclude []string) (ServerFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid server name pattern [%s]: %v", pattern, err)
+		}
+	}
+	matchAny := func(patterns []string, name string) bool {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+		return false
+	}
+	return func(name string) bool {
+		return (len(include) == 0 || matchAny(include, name)) && !matchAny(exclude, name)
+	}, nil
+}
+
+func (source *Source) filtered(name string) bool {
+	return source.options.Filter != nil && !source.options.Filter(name)
+}
+
+// sourceEntry is a server entry of a source whose stamp hasn't been decoded yet
+type sourceEntry struct {
+	name, stampStr, description string
+	tags                        []string
+	multipleStamps              bool
+}
+
+// mergeTags appends the tags of the source to the tags of a server, skipping the ones it already has
+func mergeTags(serverTags, sourceTags []string) []string {
+	if len(sourceTags) == 0 {
+		return serverTags
+	}
+	tags := make([]string, 0, len(serverTags)+len(sourceTags))
+	seen := make(map[string]bool, len(serverTags)+len(sourceTags))
+	for _, tag := range append(append([]string{}, serverTags...), sourceTags...) {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// validUTF8 returns false if the text of the entry has invalid UTF-8 sequences, as binary garbage would
+func (entry *sourceEntry) validUTF8() bool {
+	if !utf8.ValidString(entry.name) || !utf8.ValidString(entry.stampStr) || !utf8.ValidString(entry.description) {
+		return false
+	}
+	for _, tag := range entry.tags {
+		if !utf8.ValidString(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// scanEntries splits a source into entries. On a format error, the entries found before it are returned along with the error.
+func (source *Source) scanEntries(format SourceFormat, bin []byte, prefix string) ([]sourceEntry, error) {
+	switch format {
+	case SourceFormatV2:
+		return source.scanV2(bin, prefix)
+	case SourceFormatYAML:
+		return source.scanYAML(bin, prefix)
+	case SourceFormatJSON:
+		return source.scanJSON(bin, prefix)
+	}
+	dlog.Fatal("Unexpected source format")
+	return nil, nil
+}
+
+// DefaultCommentPrefixes are the prefixes of comment lines in V2 entries, unless overridden
+var DefaultCommentPrefixes = []string{"//"}
+
+func (source *Source) isComment(line string) bool {
+	prefixes := source.options.CommentPrefixes
+	if len(prefixes) == 0 {
+		prefixes = DefaultCommentPrefixes
+	}
+	for _, prefix := range prefixes {
+		if len(prefix) > 0 && strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (source *Source) scanV2(bin []byte, prefix string) ([]sourceEntry, error) {
+	var entries []sourceEntry
+	parts := strings.Split(string(bin), "## ")
+	if len(parts) < 2 {
+		return entries, fmt.Errorf("Invalid format for source at [%v]", redactedURLs(source.urls))
+	}
+	parts = parts[1:]
+	for len(parts) > 0 && strings.HasPrefix(parts[0], ".") {
+		parts = parts[1:] // directives
+	}
+	if len(parts) == 0 {
+		return entries, fmt.Errorf("Invalid format for source at [%v]", redactedURLs(source.urls))
+	}
+	for _, part := range parts {
+		part = strings.TrimFunc(part, unicode.IsSpace)
+		subparts := strings.Split(part, "\n")
+		if len(subparts) < 2 {
+			return entries, fmt.Errorf("Invalid format for source at [%v]", redactedURLs(source.urls))
+		}
+		name := strings.TrimFunc(subparts[0], unicode.IsSpace)
+		if len(name) == 0 {
+			return entries, fmt.Errorf("Invalid format for source at [%v]", redactedURLs(source.urls))
+		}
+		subparts = subparts[1:]
+		entry := sourceEntry{name: prefix + name}
+		for _, subpart := range subparts {
+			subpart = strings.TrimFunc(subpart, unicode.IsSpace)
+			if strings.HasPrefix(subpart, "sdns:") {
+				if len(entry.stampStr) > 0 {
+					entry.multipleStamps = true
+					break
+				}
+				entry.stampStr = subpart
+				continue
+			} else if len(subpart) == 0 || source.isComment(subpart) {
 				continue
 			}
-			if len(description) > 0 {
-				description += "\n"
+			if len(entry.description) > 0 {
+				entry.description += "\n"
 			}
-			description += subpart
+			entry.description += subpart
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// registerEntries decodes the stamps of the entries, returning scanErr, if any, along with the servers found before it
+func (source *Source) registerEntries(entries []sourceEntry, scanErr error) ([]RegisteredServer, error) {
+	var registeredServers []RegisteredServer
+	var stampErrs []string
+	appendStampErr := func(format string, a ...interface{}) {
+		stampErr := fmt.Sprintf(format, a...)
+		stampErrs = append(stampErrs, stampErr)
+		dlog.Warn(stampErr)
+	}
+	maxServers, dropped, filtered := source.options.MaxServers, 0, 0
+	for _, entry := range entries {
+		if source.options.CheckUTF8 && !entry.validUTF8() {
+			appendStampErr("Invalid UTF-8 sequence in the entry of server [%s]", strings.ToValidUTF8(entry.name, string(utf8.RuneError)))
+			continue
+		}
+		var nameErr error
+		if entry.name, nameErr = source.normalizeName(entry.name); nameErr != nil {
+			appendStampErr("%v", nameErr)
+			continue
+		}
+		if source.filtered(entry.name) {
+			filtered++
+			continue
+		}
+		if entry.multipleStamps {
+			appendStampErr("Multiple stamps for server [%s]", entry.name)
+			continue
+		}
+		if len(entry.stampStr) < 6 {
+			appendStampErr("Missing stamp for server [%s]", entry.name)
+			continue
+		}
+		stamp, err := stamps.NewServerStampFromString(entry.stampStr)
+		if err != nil {
+			appendStampErr("Invalid or unsupported stamp [%v]: %s", entry.stampStr, err.Error())
+			continue
+		}
+		if err := checkStamp(stamp); err != nil {
+			appendStampErr("Invalid stamp for server [%s]: %v", entry.name, err)
+			continue
 		}
-		if len(stampStr) < 6 {
-			appendStampErr("Missing stamp for server [%s]", name)
+		if err := source.checkRole(stamp); err != nil {
+			appendStampErr("Unexpected stamp for server [%s]: %v", entry.name, err)
 			continue
 		}
-		stamp, err := stamps.NewServerStampFromString(stampStr)
+		originalHost, displayHost, err := source.normalizeStampHosts(&stamp)
 		if err != nil {
-			appendStampErr("Invalid or unsupported stamp [%v]: %s", stampStr, err.Error())
+			appendStampErr("Invalid stamp for server [%s]: %v", entry.name, err)
+			continue
+		}
+		if maxServers > 0 && len(registeredServers) >= maxServers {
+			dropped++
 			continue
 		}
 		registeredServer := RegisteredServer{
-			name: name, stamp: stamp, description: description,
+			name: entry.name, stamp: stamp, description: entry.description, tags: mergeTags(entry.tags, source.options.Tags), role: source.options.Role,
+			originalHost: originalHost, displayHost: displayHost,
 		}
-		dlog.Debugf("Registered [%s] with stamp [%s]", name, stamp.String())
+		if source.options.DescribeServers {
+			descriptor := NewServerDescriptor(stamp)
+			registeredServer.descriptor = &descriptor
+		}
+		dlog.Debugf("Registered [%s] with stamp [%s]", entry.name, stamp.String())
 		registeredServers = append(registeredServers, registeredServer)
 	}
+	if filtered > 0 {
+		dlog.Debugf("Source [%s]: %d servers skipped by the filter", source.name, filtered)
+	}
+	if scanErr != nil {
+		return registeredServers, scanErr
+	}
+	if dropped > 0 {
+		if source.options.MaxServersReject {
+			return []RegisteredServer{}, fmt.Errorf("Source [%s] has more than %d servers", source.name, maxServers)
+		}
+		dlog.Warnf("Source [%s] has more than %d servers, %d were dropped", source.name, maxServers, dropped)
+	}
 	if len(stampErrs) > 0 {
 		return registeredServers, fmt.Errorf("%s", strings.Join(stampErrs, ", "))
 	}
 	return registeredServers, nil
 }
+
+// checkPort returns an error if addr has a port that is not between 1 and 65535.
+// Addresses without a port are valid, since the default port of the protocol is used.
+func checkPort(addr string) error {
+	idx := strings.LastIndex(addr, ":")
+	if idx < 0 || idx < strings.LastIndex(addr, "]") || (!strings.HasPrefix(addr, "[") && strings.Count(addr, ":") > 1) {
+		return nil
+	}
+	if port, err := strconv.Atoi(addr[idx+1:]); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("Invalid port in address [%s]", addr)
+	}
+	return nil
+}
+
+// checkStampPorts checks the ports of the server address of a stamp, and of the host name of DoH stamps
+func checkStampPorts(stamp stamps.ServerStamp) error {
+	if err := checkPort(stamp.ServerAddrStr); err != nil {
+		return err
+	}
+	if stamp.Proto == stamps.StampProtoTypeDoH {
+		return checkPort(stamp.ProviderName)
+	}
+	return nil
+}
+
+// checkStampHost checks that a stamp has a server address, or a host name for protocols that need one
+func checkStampHost(stamp stamps.ServerStamp) error {
+	addr := stamp.ServerAddrStr
+	if stamp.Proto == stamps.StampProtoTypeDoH || stamp.Proto == stamps.StampProtoTypeTLS {
+		addr = stamp.ProviderName
+	}
+	if host, _ := ExtractHostAndPort(addr, 0); len(strings.TrimSpace(host)) == 0 {
+		return fmt.Errorf("Missing host in address [%s]", addr)
+	}
+	return nil
+}
+
+// checkStamp checks a decoded stamp: the host must not be empty, and ports must be between 1 and 65535
+func checkStamp(stamp stamps.ServerStamp) error {
+	if err := checkStampHost(stamp); err != nil {
+		return err
+	}
+	return checkStampPorts(stamp)
+}
+
+// ValidateStamp decodes a stamp and checks it like the stamps of the servers of sources, with the same error messages
+func ValidateStamp(stampStr string) (stamps.ServerStamp, error) {
+	stamp, err := stamps.NewServerStampFromString(stampStr)
+	if err != nil {
+		return stamp, fmt.Errorf("Invalid or unsupported stamp [%v]: %s", stampStr, err.Error())
+	}
+	return stamp, checkStamp(stamp)
+}
+
+// SourceServerName is the name and description of a server listed by a source
+type SourceServerName struct {
+	Name        string
+	Description string
+}
+
+// ParseNames returns the names and descriptions of the servers of the source, without decoding their stamps.
+// Entries that Parse would reject for a missing or duplicate stamp are skipped, but stamps that can't be decoded aren't detected.
+func (source *Source) ParseNames(prefix string) ([]SourceServerName, error) {
+	format, err := source.contentFormat(source.in)
+	if err != nil {
+		return []SourceServerName{}, err
+	}
+	entries, err := source.scanEntries(format, source.in, prefix)
+	names := make([]SourceServerName, 0, len(entries))
+	for _, entry := range entries {
+		var nameErr error
+		if entry.name, nameErr = source.normalizeName(entry.name); nameErr != nil || source.filtered(entry.name) || entry.multipleStamps || len(entry.stampStr) < 6 {
+			continue
+		}
+		names = append(names, SourceServerName{Name: entry.name, Description: entry.description})
+	}
+	if source.options.SortServers {
+		sort.SliceStable(names, func(i, j int) bool {
+			return names[i].Name < names[j].Name
+		})
+	}
+	return names, err
+}
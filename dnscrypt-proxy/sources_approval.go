@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const DefaultApprovalTimeout = 10 * time.Minute
+
+// SourceUpdate describes verified content about to replace the current content and the cached copy of a source
+type SourceUpdate struct {
+	Source   string
+	URL      string   // without its user name and password
+	Previous []byte   // current content, nil if the source hasn't been loaded yet
+	Content  []byte   // new content, before Transform
+	Added    []string // lines of Content that are not in Previous
+	Removed  []string // lines of Previous that are not in Content
+}
+
+// SourceApprover approves or rejects an update of a source. It must return when ctx is done,
+// and the update is rejected if it doesn't return in time.
+type SourceApprover func(ctx context.Context, update SourceUpdate) bool
+
+// diffLines returns the lines of next that are not in prev, and the lines of prev that are not in next
+func diffLines(prev, next []byte) (added, removed []string) {
+	count := make(map[string]int)
+	for _, line := range strings.Split(string(prev), "\n") {
+		count[line]++
+	}
+	for _, line := range strings.Split(string(next), "\n") {
+		if count[line] > 0 {
+			count[line]--
+		} else if len(strings.TrimSpace(line)) > 0 {
+			added = append(added, line)
+		}
+	}
+	for _, line := range strings.Split(string(prev), "\n") {
+		if count[line] > 0 {
+			count[line]--
+			if len(strings.TrimSpace(line)) > 0 {
+				removed = append(removed, line)
+			}
+		}
+	}
+	return
+}
+
+// approveUpdate calls the Approve hook of the source, if there is one, for content different from the current content
+func (source *Source) approveUpdate(ctx context.Context, u *url.URL, bin []byte) error {
+	if source.options.Approve == nil {
+		return nil
+	}
+	prev := source.rawContent()
+	if prev != nil && bytes.Equal(prev, bin) {
+		return nil
+	}
+	update := SourceUpdate{Source: source.name, URL: redactedURL(u), Previous: prev, Content: bin}
+	update.Added, update.Removed = diffLines(prev, bin)
+	timeout := source.options.ApprovalTimeout
+	if timeout <= 0 {
+		timeout = DefaultApprovalTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	approved := make(chan bool, 1)
+	go func() {
+		approved <- source.options.Approve(ctx, update)
+	}()
+	select {
+	case ok := <-approved:
+		if !ok {
+			dlog.Warnf("Source [%s] update from URL [%s] rejected (%d lines added, %d removed) - Keeping the current content", source.name, redactedURL(u), len(update.Added), len(update.Removed))
+			return fmt.Errorf("Source [%s] update from URL [%s] was rejected", source.name, redactedURL(u))
+		}
+		dlog.Noticef("Source [%s] update from URL [%s] approved", source.name, redactedURL(u))
+		return nil
+	case <-ctx.Done():
+		dlog.Warnf("Source [%s] update from URL [%s] wasn't approved in time - Keeping the current content", source.name, redactedURL(u))
+		return fmt.Errorf("Source [%s] update from URL [%s] wasn't approved: %v", source.name, redactedURL(u), ctx.Err())
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+)
+
+// MaxArchiveEntries is the maximum number of entries of an archive source, including the ones that are skipped
+const MaxArchiveEntries = 1000
+
+// MaxArchiveLength is the maximum total size of the entries extracted from an archive source, each of them being
+// limited to MaxHTTPBodyLength
+const MaxArchiveLength = 4 * MaxHTTPBodyLength
+
+type archiveEntry struct {
+	name    string
+	content []byte
+}
+
+// archiveReader enforces the limits on the number of entries and on the size of the content extracted from an archive
+type archiveReader struct {
+	entries int
+	length  int
+}
+
+// next counts a new entry, and returns an error once there are more than MaxArchiveEntries
+func (ar *archiveReader) next() error {
+	if ar.entries++; ar.entries > MaxArchiveEntries {
+		return fmt.Errorf("Archive has more than %d entries", MaxArchiveEntries)
+	}
+	return nil
+}
+
+func (ar *archiveReader) readEntry(name string, r io.Reader) ([]byte, error) {
+	bin, err := ioutil.ReadAll(io.LimitReader(r, MaxHTTPBodyLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(bin) > MaxHTTPBodyLength {
+		return nil, fmt.Errorf("Archive entry [%s] is larger than %d bytes", name, MaxHTTPBodyLength)
+	}
+	if ar.length += len(bin); ar.length > MaxArchiveLength {
+		return nil, fmt.Errorf("Archive entries are larger than %d bytes in total", MaxArchiveLength)
+	}
+	return bin, nil
+}
+
+// Signatures shipped alongside the entries are not needed, since the archive itself is signed
+func skipArchiveEntry(name string) bool {
+	return strings.HasSuffix(name, ".minisig") || strings.HasPrefix(path.Base(name), ".")
+}
+
+func extractTarGz(bin []byte) (entries []archiveEntry, err error) {
+	gz, err := gzip.NewReader(bytes.NewReader(bin))
+	if err != nil {
+		return
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	var ar archiveReader
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return entries, err
+		}
+		if err = ar.next(); err != nil {
+			return entries, err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() || skipArchiveEntry(hdr.Name) {
+			continue
+		}
+		content, err := ar.readEntry(hdr.Name, tr)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, archiveEntry{name: path.Clean(hdr.Name), content: content})
+	}
+	return
+}
+
+func extractZip(bin []byte) (entries []archiveEntry, err error) {
+	zr, err := zip.NewReader(bytes.NewReader(bin), int64(len(bin)))
+	if err != nil {
+		return
+	}
+	var ar archiveReader
+	for _, f := range zr.File {
+		if err = ar.next(); err != nil {
+			return
+		}
+		if !f.Mode().IsRegular() || skipArchiveEntry(f.Name) {
+			continue
+		}
+		var rc io.ReadCloser
+		if rc, err = f.Open(); err != nil {
+			return
+		}
+		content, err := ar.readEntry(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, archiveEntry{name: path.Clean(f.Name), content: content})
+	}
+	return
+}
+
+func extractArchive(bin []byte) ([]archiveEntry, error) {
+	switch {
+	case bytes.HasPrefix(bin, []byte{0x1f, 0x8b}):
+		return extractTarGz(bin)
+	case bytes.HasPrefix(bin, []byte("PK\x03\x04")):
+		return extractZip(bin)
+	}
+	return nil, fmt.Errorf("Unsupported archive format")
+}
+
+// sourceArchive holds the sources extracted from the content of an archive source
+type sourceArchive struct {
+	in      []byte // content of the archive the sources were extracted from
+	sources []*Source
+}
+
+// checkArchiveParsable checks that an archive can be extracted, and that its entries can be parsed with the format of the source
+func (source *Source) checkArchiveParsable(bin []byte) error {
+	entries, err := extractArchive(bin)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return errors.New("Empty archive")
+	}
+	for _, entry := range entries {
+		if _, err = source.scanEntries(source.format, entry.content, ""); err != nil {
+			return fmt.Errorf("Archive entry [%s]: %v", entry.name, err)
+		}
+	}
+	return nil
+}
+
+// ArchiveSources extracts the entries of a verified archive, returning each of them as a separate source. The same sources
+// are returned until the archive changes: they are then updated in place when it is loaded, sources are added for new entries,
+// and the ones of removed entries are no longer returned. They have no URLs nor cache file: the archive is cached instead.
+func (source *Source) ArchiveSources() ([]*Source, error) {
+	source.archiveLock.Lock()
+	defer source.archiveLock.Unlock()
+	if source.archive != nil && bytes.Equal(source.archive.in, source.in) {
+		return source.archive.sources, nil
+	}
+	return source.extractArchiveSources()
+}
+
+// extractArchiveSources extracts the sources of the archive, reusing the ones of the previous extraction with the same name
+func (source *Source) extractArchiveSources() ([]*Source, error) {
+	entries, err := extractArchive(source.in)
+	if err != nil {
+		return nil, fmt.Errorf("Source [%s]: %v", source.name, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("Source [%s]: empty archive", source.name)
+	}
+	previous := make(map[string]*Source)
+	if source.archive != nil {
+		for _, sub := range source.archive.sources {
+			previous[sub.name] = sub
+		}
+	}
+	sources := make([]*Source, 0, len(entries))
+	for _, entry := range entries {
+		name := source.name + "/" + entry.name
+		if sub, ok := previous[name]; ok {
+			// already returned to callers, which may be refreshing it
+			sub.refreshLock.Lock()
+			sub.setContent(entry.content, entry.content)
+			sub.snapshotStatus()
+			sub.refreshLock.Unlock()
+			sources = append(sources, sub)
+			continue
+		}
+		options := source.options
+		options.Archive, options.Offline = false, true
+		sub := &Source{
+			name: name, format: source.format, in: entry.content,
+			minisignKeys: source.minisignKeys, cacheTTL: source.cacheTTL, prefetchDelay: source.prefetchDelay, options: options,
+		}
+		sub.snapshotStatus()
+		sources = append(sources, sub)
+	}
+	source.archive = &sourceArchive{in: source.in, sources: sources}
+	return sources, nil
+}
+
+// refreshArchive extracts the sources of the archive again after its content changed, if they were extracted before.
+// The previous sources are kept if the new archive can't be extracted.
+func (source *Source) refreshArchive() {
+	source.archiveLock.Lock()
+	defer source.archiveLock.Unlock()
+	if source.archive == nil || bytes.Equal(source.archive.in, source.in) {
+		return
+	}
+	if _, err := source.extractArchiveSources(); err != nil {
+		dlog.Warnf("%v - Keeping the sources of the previous archive", err)
+		return
+	}
+	dlog.Noticef("Source [%s] archive changed, its entries were extracted again", source.name)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// redactURL removes the user name and password from a URL, so that it can be logged, even if the URL can't be parsed
+func redactURL(urlStr string) string {
+	i := strings.Index(urlStr, "://")
+	if i < 0 {
+		return urlStr
+	}
+	authority := urlStr[i+3:]
+	if end := strings.IndexAny(authority, "/?#"); end >= 0 {
+		authority = authority[:end]
+	}
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		return urlStr[:i+3] + urlStr[i+3+at+1:]
+	}
+	return urlStr
+}
+
+// redactURLError removes the user name and password from the URL included in an error returned by url.Parse
+func redactURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return &url.Error{Op: urlErr.Op, URL: redactURL(urlErr.URL), Err: urlErr.Err}
+	}
+	return err
+}
+
+// redactedURL returns a URL of a source without its user name and password, so that it can be logged.
+// Credentials are removed from the URLs of sources, except from Git URLs, which keep them for git.
+func redactedURL(u *url.URL) string {
+	return redactURL(u.String())
+}
+
+// redactedURLs returns the URLs of a source without their user names and passwords, so that they can be logged
+func redactedURLs(urls []*url.URL) []string {
+	redacted := make([]string, len(urls))
+	for i, u := range urls {
+		redacted[i] = redactedURL(u)
+	}
+	return redacted
+}
+
+func credentialsKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// takeCredentials removes the user name and password from a URL of the source, which are then sent using basic authentication
+// with all the requests to the same host, including for signatures. Git URLs are left as-is, since git handles them,
+// and must be logged with redactedURL.
+func (source *Source) takeCredentials(u *url.URL) {
+	if u.User == nil || isGitURL(u) {
+		return
+	}
+	if source.credentials == nil {
+		source.credentials = make(map[string]*url.Userinfo)
+	}
+	source.credentials[credentialsKey(u)] = u.User
+	u.User = nil
+}
+
+// authenticate returns the URL to send a request to without its credentials, if it has any, and the header
+// with an Authorization header for the credentials of the URL or of its host
+func (source *Source) authenticate(u *url.URL, header http.Header) (*url.URL, http.Header) {
+	user := u.User
+	if user != nil {
+		stripped := *u
+		stripped.User = nil
+		u = &stripped
+	} else if user = source.credentials[credentialsKey(u)]; user == nil {
+		return u, header
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return u, header
+	}
+	password, _ := user.Password()
+	authHeader := make(http.Header, len(header)+1)
+	for name, values := range header {
+		authHeader[name] = values
+	}
+	authHeader.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	return u, authHeader
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BandwidthLimiter is a token bucket limiting the rate at which sources are downloaded. The same limiter can be set as the
+// SharedBandwidth of several sources to cap the bandwidth they use together, whatever the number of concurrent downloads.
+type BandwidthLimiter struct {
+	lock   sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64 // size of the bucket, in bytes
+	tokens float64
+	last   time.Time
+}
+
+// NewBandwidthLimiter returns a limiter allowing bytesPerSecond on average, in bursts of up to a second worth of it
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	return &BandwidthLimiter{rate: float64(bytesPerSecond), burst: float64(bytesPerSecond), tokens: float64(bytesPerSecond)}
+}
+
+// reserve takes n bytes from the bucket, and returns how long to wait before reading them, until the bucket is no longer in debt
+func (limiter *BandwidthLimiter) reserve(n int, now time.Time) time.Duration {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	if !limiter.last.IsZero() && now.After(limiter.last) {
+		limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+		if limiter.tokens > limiter.burst {
+			limiter.tokens = limiter.burst
+		}
+	}
+	limiter.last = now
+	limiter.tokens -= float64(n)
+	if limiter.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+}
+
+// throttledBody reads the body of a response, no faster than all the limiters allow
+type throttledBody struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*BandwidthLimiter
+	chunk    int // maximum size of a read, so that reads don't exceed the bursts of the limiters
+}
+
+func (body *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > body.chunk {
+		p = p[:body.chunk]
+	}
+	n, err := body.ReadCloser.Read(p)
+	var wait time.Duration
+	now := time.Now()
+	for _, limiter := range body.limiters {
+		if delay := limiter.reserve(n, now); delay > wait {
+			wait = delay // the tightest limit wins
+		}
+	}
+	if wait > 0 {
+		if waitErr := throttleWait(body.ctx, wait); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// throttleWait pauses a throttled download, unless ctx is done first, and can be replaced by tests
+var throttleWait = func(ctx context.Context, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledTransport throttles the bodies of the responses to the requests sent with the transport it wraps
+type throttledTransport struct {
+	base     http.RoundTripper
+	limiters []*BandwidthLimiter
+}
+
+func (transport *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := transport.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	chunk := 0
+	for _, limiter := range transport.limiters {
+		if burst := int(limiter.burst); chunk == 0 || burst < chunk {
+			chunk = burst
+		}
+	}
+	if chunk < 1 {
+		chunk = 1
+	}
+	resp.Body = &throttledBody{ReadCloser: resp.Body, ctx: req.Context(), limiters: transport.limiters, chunk: chunk}
+	return resp, nil
+}
+
+func (transport *throttledTransport) CloseIdleConnections() {
+	if closer, ok := transport.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// throttle wraps a transport to limit downloads to MaxBandwidth and SharedBandwidth, if they are set.
+// Downloads from Git repositories are not limited, since they are made by the git command.
+func (source *Source) throttle(transport http.RoundTripper) http.RoundTripper {
+	limiters := source.limiters()
+	if len(limiters) == 0 {
+		return transport
+	}
+	return &throttledTransport{base: transport, limiters: limiters}
+}
+
+func (source *Source) limiters() []*BandwidthLimiter {
+	var limiters []*BandwidthLimiter
+	for _, limiter := range []*BandwidthLimiter{source.bandwidth, source.options.SharedBandwidth} {
+		if limiter != nil && limiter.rate > 0 {
+			limiters = append(limiters, limiter)
+		}
+	}
+	return limiters
+}
+
+// maxThroughput returns the rate of the tightest limit on the downloads of the source in bytes per second, 0 if they are not limited
+func (source *Source) maxThroughput() int64 {
+	var throughput int64
+	for _, limiter := range source.limiters() {
+		if rate := int64(limiter.rate); throughput == 0 || rate < throughput {
+			throughput = rate
+		}
+	}
+	return throughput
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+)
+
+// A signature bundle is a single file made of the content of a source, immediately followed by
+// SignatureBundleSeparator and by the content of the matching .minisig file:
+//
+//	<content>\n-----BEGIN MINISIGN SIGNATURE-----\n<minisig>
+//
+// The separator always starts with a newline of its own, so that the content is kept byte for byte,
+// even if it doesn't end with a newline. Bundles are split at the last occurrence of the separator,
+// since the signature itself never contains it.
+const SignatureBundleSeparator = "\n-----BEGIN MINISIGN SIGNATURE-----\n"
+
+var errNoSignatureInBundle = errors.New("No signature found in bundle")
+
+func makeSignatureBundle(bin, sig []byte) []byte {
+	bundle := make([]byte, 0, len(bin)+len(SignatureBundleSeparator)+len(sig))
+	bundle = append(bundle, bin...)
+	bundle = append(bundle, SignatureBundleSeparator...)
+	return append(bundle, sig...)
+}
+
+func splitSignatureBundle(bundle []byte) (bin, sig []byte, err error) {
+	i := bytes.LastIndex(bundle, []byte(SignatureBundleSeparator))
+	if i < 0 {
+		return nil, nil, errNoSignatureInBundle
+	}
+	return bundle[:i], bundle[i+len(SignatureBundleSeparator):], nil
+}
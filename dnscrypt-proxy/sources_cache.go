@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dchest/safefile"
+
+	"github.com/jedisct1/dlog"
+)
+
+const StaleTempMinAge = time.Hour // minimum age of the temporary files removed at startup
+
+// safefileTempName matches the names of the temporary files created by safefile in the directory of the files it writes
+var safefileTempName = regexp.MustCompile(`^sf-[a-z2-7]{16}\.tmp$`)
+
+// CacheStore persists cached copies of sources and of their signatures
+type CacheStore interface {
+	Read(name string) ([]byte, error)
+	Write(ctx context.Context, name string, bin []byte) error // must not leave a partial file if ctx is canceled
+	Stat(name string) (modTime time.Time, err error)
+	Touch(name string, modTime time.Time) error
+	Remove(name string) error // must not fail if there is nothing to remove
+}
+
+// fileCacheStore is the default store, atomically writing files to the local file system
+type fileCacheStore struct{}
+
+func (fileCacheStore) Read(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+// Write doesn't start if ctx is canceled. safefile writes to a temporary file, renamed once synced, and removed on failure.
+func (fileCacheStore) Write(ctx context.Context, name string, bin []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return safefile.WriteFile(name, bin, 0644)
+}
+
+// StaleTempCleanup removes the temporary files left by writes of the given cache files that were interrupted, such as by a crash.
+// Only files older than minAge are removed, so that writes still in progress are not affected. safefile names temporary files
+// after nothing but random characters, so the ones of all the files written with safefile to the directories of the cache files
+// are removed, and other files of these directories are never removed.
+func StaleTempCleanup(cacheFiles []string, minAge time.Duration) error {
+	dirs := make(map[string]bool)
+	for _, name := range cacheFiles {
+		dirs[filepath.Dir(name)] = true
+	}
+	now := timeNow()
+	for dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !file.Mode().IsRegular() || !safefileTempName.MatchString(file.Name()) || now.Sub(file.ModTime()) < minAge {
+				continue
+			}
+			path := filepath.Join(dir, file.Name())
+			if err := os.Remove(path); err != nil {
+				dlog.Warnf("Unable to remove stale temporary file [%s]: %v", path, err)
+				continue
+			}
+			dlog.Infof("Removed stale temporary file [%s]", path)
+		}
+	}
+	return nil
+}
+
+func (fileCacheStore) Stat(name string) (time.Time, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+func (fileCacheStore) Touch(name string, modTime time.Time) error {
+	return os.Chtimes(name, modTime, modTime)
+}
+
+func (fileCacheStore) Remove(name string) error {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+type memoryCacheEntry struct {
+	bin     []byte
+	modTime time.Time
+}
+
+// MemoryCacheStore keeps cached sources in memory, for tests and for sources that must not be persisted
+type MemoryCacheStore struct {
+	sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+func NewMemoryCacheStore() *MemoryCacheStore {
+	return &MemoryCacheStore{entries: make(map[string]memoryCacheEntry)}
+}
+
+func (store *MemoryCacheStore) entry(op, name string) (memoryCacheEntry, error) {
+	entry, ok := store.entries[name]
+	if !ok {
+		return entry, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return entry, nil
+}
+
+func (store *MemoryCacheStore) Read(name string) ([]byte, error) {
+	store.Lock()
+	defer store.Unlock()
+	entry, err := store.entry("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, entry.bin...), nil
+}
+
+func (store *MemoryCacheStore) Write(ctx context.Context, name string, bin []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	store.Lock()
+	store.entries[name] = memoryCacheEntry{bin: append([]byte{}, bin...), modTime: timeNow()}
+	store.Unlock()
+	return nil
+}
+
+func (store *MemoryCacheStore) Stat(name string) (time.Time, error) {
+	store.Lock()
+	defer store.Unlock()
+	entry, err := store.entry("stat", name)
+	return entry.modTime, err
+}
+
+func (store *MemoryCacheStore) Touch(name string, modTime time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+	entry, err := store.entry("chtimes", name)
+	if err != nil {
+		return err
+	}
+	entry.modTime = modTime
+	store.entries[name] = entry
+	return nil
+}
+
+func (store *MemoryCacheStore) Remove(name string) error {
+	store.Lock()
+	delete(store.entries, name)
+	store.Unlock()
+	return nil
+}
+
+// CacheWriteHealth reports whether the cached copy of a source can be written.
+// When the disk is full, writes are suspended for a while, doubled after each failure, and the source keeps working from memory.
+type CacheWriteHealth struct {
+	Failures       int       // consecutive failed writes
+	LastError      string    // error of the last failed write, if the last write failed
+	DiskFull       bool      // the last write failed because there was no space left
+	SuspendedUntil time.Time // writes are skipped until then, if the disk is full
+}
+
+// isDiskFull returns true if err means that there is no space left on the device
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+func (source *Source) recordCacheWrite(err error, now time.Time) {
+	source.statsLock.Lock()
+	defer source.statsLock.Unlock()
+	health := &source.cacheWrite
+	if err == nil {
+		if health.DiskFull {
+			dlog.Noticef("Source [%s] cache can be written again", source.name)
+		}
+		*health = CacheWriteHealth{}
+		return
+	}
+	health.Failures++
+	health.LastError = err.Error()
+	if !isDiskFull(err) {
+		health.DiskFull, health.SuspendedUntil = false, time.Time{}
+		return
+	}
+	backoff := MinimumPrefetchInterval << uint(health.Failures-1)
+	if backoff > DefaultPrefetchDelay || backoff <= 0 {
+		backoff = DefaultPrefetchDelay
+	}
+	if !health.DiskFull {
+		dlog.Warnf("Source [%s] cache file [%s] can't be written, the disk is full - The source is used from memory, and cache writes are retried less often", source.name, source.cacheFile)
+	} else {
+		dlog.Debugf("Source [%s] cache file [%s] still can't be written: %v", source.name, source.cacheFile, err)
+	}
+	health.DiskFull, health.SuspendedUntil = true, now.Add(backoff)
+}
+
+// CacheWriteHealth returns the result of the last writes of the cached copy of the source
+func (source *Source) CacheWriteHealth() CacheWriteHealth {
+	source.statsLock.Lock()
+	defer source.statsLock.Unlock()
+	return source.cacheWrite
+}
+
+// CacheFileForSource returns the path of a cache file in dir for a source, derived from its name.
+// Characters other than letters, digits, '-', '_' and '.' are percent-encoded, so that names containing
+// path separators or traversal sequences can't refer to a file outside of dir.
+func CacheFileForSource(dir, name string) (string, error) {
+	base := escapeCacheName(name)
+	if base == "" || base == "." || base == ".." {
+		return "", fmt.Errorf("Invalid source name for a cache file: [%s]", name)
+	}
+	cacheFile := filepath.Join(dir, base)
+	if rel, err := filepath.Rel(dir, cacheFile); err != nil || rel != base {
+		return "", fmt.Errorf("Cache file for source [%s] would be outside of [%s]", name, dir)
+	}
+	return cacheFile, nil
+}
+
+// escapeCacheName percent-encodes the characters of name other than letters, digits, '-', '_' and '.'
+func escapeCacheName(name string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// CachedContent returns the content and the signature of the source, exactly as cached. The signature is nil with NoCacheSignature.
+func (source *Source) CachedContent() (bin, sig []byte, err error) {
+	store := source.cacheStore()
+	if bin, err = store.Read(source.cacheFile); err == nil && !source.options.NoCacheSignature {
+		sig, err = store.Read(source.sigCacheFile())
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("Source [%s] has no cached copy: %v", source.name, err)
+		}
+		return nil, nil, err
+	}
+	return bin, sig, nil
+}
+
+// CheckCache verifies the cached copy of the source like when it is loaded, without downloading nor changing anything, not
+// even the schedule of the source. An error is returned unless the source has a cached copy that can be used, even if it has expired.
+func (source *Source) CheckCache() error {
+	_, in, formatStr, err := source.readCache()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("Source [%s] has no cached copy: %v", source.name, err)
+		}
+		return fmt.Errorf("Source [%s] cached copy can't be used: %v", source.name, err)
+	}
+	if err = source.checkParsableAs(formatStr, in); err != nil {
+		return fmt.Errorf("Source [%s] cached copy can't be parsed: %v", source.name, err)
+	}
+	return nil
+}
+
+// CheckSourcesCache runs CheckCache for each source, for example for a readiness probe telling whether the proxy can
+// start without network access. An error is returned for each source without a usable cached copy, keyed by name.
+func CheckSourcesCache(sources []*Source) map[string]error {
+	errs := make(map[string]error)
+	for _, source := range sources {
+		if err := source.CheckCache(); err != nil {
+			errs[source.name] = err
+		}
+	}
+	return errs
+}
+
+// cacheFiles returns the names of all the files the source can cache
+func (source *Source) cacheFiles() []string {
+	keyManifestFile := source.cacheFile + keyManifestSuffix
+	return []string{source.cacheFile, source.sigCacheFile(), source.sigCacheFile() + pendingSignatureSuffix, source.metadataFile(),
+		keyManifestFile, keyManifestFile + source.signatureSuffix()}
+}
+
+// InvalidateCache removes the cached copy of the source and its signature, for example if the cache may have been tampered with,
+// so that the next refresh downloads the source again. The content in memory is discarded as well. The metadata of the cached
+// copy and the cached key manifest are removed too, but the keys pinned with PinKeys and the timestamp of the last key
+// manifest accepted are kept, so that they can't be reset by invalidating the cache. The servers previously parsed are
+// forgotten, so that the last good ones are not returned by Parse, and so are the sources extracted from an archive.
+func (source *Source) InvalidateCache() error {
+	source.refreshLock.Lock()
+	defer source.refreshLock.Unlock()
+	defer source.snapshotStatus()
+	store := source.cacheStore()
+	meta, err := source.readMetadata()
+	if err != nil {
+		meta = sourceMetadata{}
+	}
+	for _, name := range source.cacheFiles() {
+		if err := store.Remove(name); err != nil {
+			return fmt.Errorf("Unable to invalidate the cache of source [%s]: %v", source.name, err)
+		}
+	}
+	kept := sourceMetadata{KeyManifestTimestamp: meta.KeyManifestTimestamp}
+	if source.options.PinKeys {
+		kept.KeyIDs = meta.KeyIDs
+	}
+	if len(kept.KeyIDs) > 0 || kept.KeyManifestTimestamp != 0 {
+		if err := source.writeMetadata(kept); err != nil {
+			return fmt.Errorf("Unable to keep the pinned keys of source [%s]: %v", source.name, err)
+		}
+	}
+	source.discardContent()
+	if len(source.urls) > 0 && !source.options.Offline {
+		source.refresh = timeNow() // refreshed by the next PrefetchSources
+	}
+	dlog.Noticef("Source [%s] cache invalidated", source.name)
+	return nil
+}
+
+// discardContent forgets the content of the source, the servers parsed from it and the sources extracted from it, if it is an archive
+func (source *Source) discardContent() {
+	source.in, source.rawIn, source.lastSuccessfulURL, source.hintedDelay, source.negotiatedFormat = nil, nil, "", 0, ""
+	source.statsLock.Lock()
+	source.serverNames, source.lastGood, source.lastGoodPrefix, source.parseError = nil, nil, "", ""
+	source.statsLock.Unlock()
+	source.archiveLock.Lock()
+	defer source.archiveLock.Unlock()
+	if source.archive != nil {
+		for _, sub := range source.archive.sources {
+			sub.discardContent()
+		}
+		source.archive = nil
+	}
+}
+
+// sourceMetadata is stored next to the cached copy of a source
+type sourceMetadata struct {
+	KeyIDs []string `json:"key_ids,omitempty"`
+	Format string   `json:"format,omitempty"` // format negotiated for the cached copy, see AcceptFormats
+	Commit string   `json:"commit,omitempty"` // Git commit the cached copy was loaded from, see fetchFromGit
+	// time at which the last key manifest accepted was signed, in seconds since the epoch, see checkKeyManifestReplay
+	KeyManifestTimestamp int64 `json:"key_manifest_timestamp,omitempty"`
+}
+
+func (source *Source) metadataFile() string {
+	return source.cacheFile + ".meta"
+}
+
+func (source *Source) readMetadata() (meta sourceMetadata, err error) {
+	var bin []byte
+	if bin, err = source.cacheStore().Read(source.metadataFile()); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(bin, &meta)
+	return
+}
+
+func (source *Source) writeMetadata(meta sourceMetadata) error {
+	bin, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return source.cacheStore().Write(context.Background(), source.metadataFile(), bin)
+}
+
+// cachedCommit returns the Git commit the content of the source was loaded from, or an empty string if it wasn't loaded from a Git URL
+func (source *Source) cachedCommit() string {
+	if len(source.rawContent()) == 0 {
+		return ""
+	}
+	meta, err := source.readMetadata()
+	if err != nil {
+		return ""
+	}
+	return meta.Commit
+}
+
+// recordCommit records the Git commit of new content loaded from loadedURL in the metadata of the cached copy,
+// or forgets the previous one if the content wasn't loaded from a Git URL, so that the commit always matches the cached copy
+func (source *Source) recordCommit(loadedURL *url.URL) error {
+	commit := ""
+	if isGitURL(loadedURL) {
+		commit = loadedURL.Query().Get("ref")
+	}
+	meta, err := source.readMetadata()
+	if err != nil {
+		return err
+	}
+	if meta.Commit == commit {
+		return nil
+	}
+	meta.Commit = commit
+	return source.writeMetadata(meta)
+}
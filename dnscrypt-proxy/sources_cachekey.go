@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// CacheKey identifies the cached copy of a source, to derive the path of its cache file with a CacheKeyFunc
+type CacheKey struct {
+	CacheFile string   // cache file of the source, as given to NewSource
+	Tenant    string   // Tenant option of the source
+	KeyIDs    []string // sorted IDs of the configured keys of the source, as displayed by minisign, without the keys of its KeyManifestURL
+}
+
+// CacheKeyFunc returns the path of the cache file of a source, to which the suffixes of its signature and metadata are added
+type CacheKeyFunc func(key CacheKey) string
+
+// DefaultCacheKey uses the cache file of the source as it is, like sources without a CacheKeyFunc
+func DefaultCacheKey(key CacheKey) string {
+	return key.CacheFile
+}
+
+// TenantCacheKey adds the tenant and the key IDs of the source to its cache file, so that sources sharing a URL and a cache file
+// for several tenants, or with different keys, each have their own cached copy, ex: relays.md.tenant-a.E1BA6F5C5B4D6A2F
+func TenantCacheKey(key CacheKey) string {
+	cacheFile := key.CacheFile
+	if len(key.Tenant) > 0 {
+		cacheFile += "." + escapeCacheName(key.Tenant)
+	}
+	if len(key.KeyIDs) > 0 {
+		cacheFile += "." + strings.Join(key.KeyIDs, "-")
+	}
+	return cacheFile
+}
+
+// deriveCacheFile returns the path of the cache file of a source with the given keys, according to its CacheKey option
+func deriveCacheFile(cacheFile string, keys []sourceKey, options SourceOptions) string {
+	if options.CacheKey == nil {
+		return cacheFile
+	}
+	key := CacheKey{CacheFile: cacheFile, Tenant: options.Tenant, KeyIDs: make([]string, 0, len(keys))}
+	for _, k := range keys {
+		key.KeyIDs = append(key.KeyIDs, k.id)
+	}
+	sort.Strings(key.KeyIDs)
+	return options.CacheKey(key)
+}
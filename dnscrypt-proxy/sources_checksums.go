@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// checksumManifestSuffix is added to the URL of a source to get its checksum manifest, see ChecksumManifest
+const checksumManifestSuffix = ".sha256"
+
+// checksumManifest maps file names to their SHA-256 hashes
+type checksumManifest map[string][]byte
+
+// parseChecksumManifest decodes a checksum manifest, in the format of sha256sum: one line per file, with the hexadecimal hash,
+// spaces, and the name of the file, optionally prefixed with '*'. Empty lines and lines starting with '#' are skipped.
+func parseChecksumManifest(bin []byte) (checksumManifest, error) {
+	manifest := make(checksumManifest)
+	for i, line := range strings.Split(string(bin), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid line %d of the checksum manifest", i+1)
+		}
+		hash, err := hex.DecodeString(parts[0])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("Invalid SHA-256 hash at line %d of the checksum manifest", i+1)
+		}
+		manifest[strings.TrimPrefix(parts[1], "*")] = hash
+	}
+	if len(manifest) == 0 {
+		return nil, fmt.Errorf("Empty checksum manifest")
+	}
+	return manifest, nil
+}
+
+// check verifies that a downloaded file has the hash listed for it in the manifest
+func (manifest checksumManifest) check(name string, bin []byte) error {
+	expected, ok := manifest[name]
+	if !ok {
+		return fmt.Errorf("[%s] is not listed in the checksum manifest", name)
+	}
+	if hash := sha256.Sum256(bin); !bytes.Equal(hash[:], expected) {
+		return fmt.Errorf("[%s] doesn't match the checksum manifest (%d bytes), it may be truncated or replaced", name, len(bin))
+	}
+	return nil
+}
+
+// checksumNames returns the names the content of a URL of the source and its signature are listed under in checksum manifests
+func (source *Source) checksumNames(srcURL *url.URL) (contentName, sigName string) {
+	contentName = path.Base(srcURL.Path)
+	return contentName, contentName + source.signatureSuffix()
+}
+
+// fetchChecksumManifest downloads the checksum manifest of a URL of the source, and returns it once its signature has been checked
+func (source *Source) fetchChecksumManifest(ctx context.Context, xTransport *XTransport, srcURL *url.URL) (checksumManifest, error) {
+	manifestURL := signatureURL(srcURL, checksumManifestSuffix, source.options.SignatureAfterQuery)
+	bin, err := source.fetchFromURL(ctx, xTransport, manifestURL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to download the checksum manifest [%s]: %v", redactedURL(manifestURL), err)
+	}
+	sigURL := signatureURL(manifestURL, source.signatureSuffix(), source.options.SignatureAfterQuery)
+	sig, err := source.fetchSignatureWithRetries(ctx, xTransport, sigURL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to download the signature of the checksum manifest [%s]: %v", redactedURL(sigURL), err)
+	}
+	if err = source.checkSignature(bin, sig); err != nil {
+		return nil, fmt.Errorf("Invalid signature of the checksum manifest [%s]: %v", redactedURL(manifestURL), err)
+	}
+	return parseChecksumManifest(bin)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+// stampIdentity returns what identifies the server a stamp points to: its protocol, address, public key, provider name, path
+// and certificate hashes. Properties are ignored, names are compared without case and hashes regardless of their order, so
+// that the entries of different lists for the same server have the same identity.
+func stampIdentity(stamp stamps.ServerStamp) string {
+	hashes := make([]string, len(stamp.Hashes))
+	for i, hash := range stamp.Hashes {
+		hashes[i] = hex.EncodeToString(hash)
+	}
+	sort.Strings(hashes)
+	return strings.Join([]string{
+		strconv.Itoa(int(stamp.Proto)), strings.ToLower(stamp.ServerAddrStr), hex.EncodeToString(stamp.ServerPk),
+		strings.ToLower(stamp.ProviderName), stamp.Path, strings.Join(hashes, ","),
+	}, "|")
+}
+
+// dedupServers keeps the first of the parsed servers that have the same name with DedupNames, or the same stamp identity
+// with DedupStamps, see stampIdentity. Every server that is dropped is logged.
+func (source *Source) dedupServers(registeredServers []RegisteredServer) []RegisteredServer {
+	if !source.options.DedupNames && !source.options.DedupStamps {
+		return registeredServers
+	}
+	names := make(map[string]bool, len(registeredServers))
+	identities := make(map[string]string, len(registeredServers))
+	kept := make([]RegisteredServer, 0, len(registeredServers))
+	for _, registeredServer := range registeredServers {
+		if source.options.DedupNames {
+			if names[registeredServer.name] {
+				dlog.Noticef("Source [%s] lists server [%s] more than once, only the first entry is kept", source.name, registeredServer.name)
+				continue
+			}
+			names[registeredServer.name] = true
+		}
+		if source.options.DedupStamps {
+			identity := stampIdentity(registeredServer.stamp)
+			if first, ok := identities[identity]; ok {
+				dlog.Noticef("Server [%s] of source [%s] has the same stamp as [%s], and was merged into it", registeredServer.name, source.name, first)
+				continue
+			}
+			identities[identity] = registeredServer.name
+		}
+		kept = append(kept, registeredServer)
+	}
+	return kept
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+// ServerDescriptor holds the properties of the stamp of a server in a directly usable form
+type ServerDescriptor struct {
+	Proto    stamps.StampProtoType
+	Host     string // host name for DoH servers, IP address otherwise
+	Port     int
+	Path     string // path of DoH servers
+	DNSSEC   bool
+	NoLog    bool
+	NoFilter bool
+}
+
+// stampDefaultPort returns the port of the servers of the given protocol whose stamps have an address without a port
+func stampDefaultPort(proto stamps.StampProtoType) int {
+	switch proto {
+	case stamps.StampProtoTypePlain:
+		return 53
+	case stamps.StampProtoTypeTLS:
+		return 853
+	}
+	return stamps.DefaultPort
+}
+
+// NewServerDescriptor extracts the properties of a stamp
+func NewServerDescriptor(stamp stamps.ServerStamp) ServerDescriptor {
+	hostPort := stamp.ServerAddrStr
+	if stamp.Proto == stamps.StampProtoTypeDoH && len(stamp.ProviderName) > 0 {
+		hostPort = stamp.ProviderName
+	}
+	host, port := ExtractHostAndPort(hostPort, stampDefaultPort(stamp.Proto))
+	return ServerDescriptor{
+		Proto:    stamp.Proto,
+		Host:     strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"),
+		Port:     port,
+		Path:     stamp.Path,
+		DNSSEC:   stamp.Props&stamps.ServerInformalPropertyDNSSEC != 0,
+		NoLog:    stamp.Props&stamps.ServerInformalPropertyNoLog != 0,
+		NoFilter: stamp.Props&stamps.ServerInformalPropertyNoFilter != 0,
+	}
+}
+
+// Descriptor returns the properties of the stamp of the server, such as DNSSEC, NoLog and NoFilter: the descriptor
+// attached with DescribeServers, or else one extracted from the stamp, which only takes a few comparisons
+func (registeredServer *RegisteredServer) Descriptor() ServerDescriptor {
+	if registeredServer.descriptor != nil {
+		return *registeredServer.descriptor
+	}
+	return NewServerDescriptor(registeredServer.stamp)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// contentEncodings are accepted to download sources in builds supporting zstd.
+// Setting Accept-Encoding disables the transparent gzip decompression done by net/http, so gzip is decoded by decodeContent as well.
+const contentEncodings = "zstd, gzip"
+
+// readDecompressed reads decompressed content, rejecting it if it is larger than MaxHTTPBodyLength
+func readDecompressed(r io.Reader) ([]byte, error) {
+	bin, err := ioutil.ReadAll(io.LimitReader(r, MaxHTTPBodyLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(bin) > MaxHTTPBodyLength {
+		return nil, fmt.Errorf("Decompressed content is larger than %d bytes", MaxHTTPBodyLength)
+	}
+	return bin, nil
+}
+
+// acceptEncodings returns a copy of header requesting compressed content, if zstd is supported
+func acceptEncodings(header http.Header) http.Header {
+	if !zstdSupported {
+		return header
+	}
+	withEncodings := http.Header{"Accept-Encoding": {contentEncodings}}
+	for name, values := range header {
+		withEncodings[name] = values
+	}
+	return withEncodings
+}
+
+// decodeContent decompresses content downloaded with acceptEncodings, according to its Content-Encoding header
+func decodeContent(bin []byte, respHeader http.Header) ([]byte, error) {
+	if !zstdSupported || len(bin) == 0 { // such as the responses to HEAD requests
+		return bin, nil
+	}
+	switch encoding := strings.ToLower(strings.TrimSpace(respHeader.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return bin, nil
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(bin))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return readDecompressed(gz)
+	case "zstd":
+		return decompressZstd(bin)
+	default:
+		return nil, fmt.Errorf("Unsupported content encoding: [%s]", encoding)
+	}
+}
@@ -0,0 +1,98 @@
+// +build gitsources
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+)
+
+// fetchFromGit fetches a single commit of a repository, and returns the source and its signature at that commit,
+// along with a URL pinned to the commit, that can be used to fetch the same content again.
+// If the ref points to cachedCommit, nothing is fetched, and bin and sig are nil.
+// The git command must be installed.
+func (source *Source) fetchFromGit(ctx context.Context, srcURL *url.URL, cachedCommit string) (bin, sig []byte, commitURL *url.URL, err error) {
+	repo, ref, filePath, err := parseGitURL(srcURL)
+	if err != nil {
+		return
+	}
+	dir, err := ioutil.TempDir("", "dnscrypt-proxy-git-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithTimeout(ctx, source.fetchTimeout().Base)
+	defer cancel()
+	git := func(args ...string) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+		// the transport of the repository is the only one git may use, even if it is redirected or has submodules
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL="+strings.TrimPrefix(srcURL.Scheme, gitURLPrefix))
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
+		out, readErr := ioutil.ReadAll(io.LimitReader(stdout, MaxHTTPBodyLength+1))
+		if len(out) > MaxHTTPBodyLength {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, fmt.Errorf("git %s: output larger than %d bytes", args[0], MaxHTTPBodyLength)
+		}
+		if err = cmd.Wait(); err != nil {
+			if _, ok := err.(*exec.ExitError); ok {
+				err = fmt.Errorf("git %s: %s", args[0], strings.ReplaceAll(strings.TrimSpace(stderr.String()), repo, redactURL(repo)))
+			}
+			return nil, err
+		}
+		return out, readErr
+	}
+	commit := ref
+	if !isCommitHash(ref) {
+		var refs []byte
+		if refs, err = git("ls-remote", "--", repo, ref); err != nil {
+			return
+		}
+		fields := strings.Fields(string(refs))
+		if len(fields) == 0 {
+			return nil, nil, nil, fmt.Errorf("Ref [%s] not found in [%s]", ref, redactURL(repo))
+		}
+		commit = fields[0]
+	}
+	if len(cachedCommit) > 0 && commit == cachedCommit {
+		dlog.Infof("Source [%s] cached copy is at commit [%s] of [%s] already", source.name, commit, redactURL(repo))
+		return nil, nil, gitCommitURL(srcURL, commit), nil
+	}
+	if _, err = git("init", "-q"); err != nil {
+		return
+	}
+	if _, err = git("fetch", "-q", "--depth", "1", "--", repo, ref); err != nil {
+		return
+	}
+	var fetched []byte
+	if fetched, err = git("rev-parse", "FETCH_HEAD"); err != nil {
+		return
+	}
+	commit = strings.TrimSpace(string(fetched)) // the ref may have moved since it was resolved
+	commitURL = gitCommitURL(srcURL, commit)
+	if bin, err = git("show", "FETCH_HEAD:"+filePath); err != nil {
+		return
+	}
+	if sig, err = git("show", "FETCH_HEAD:"+filePath+source.signatureSuffix()); err != nil {
+		return
+	}
+	dlog.Infof("Source [%s] loaded commit [%s] of [%s]", source.name, commit, redactURL(repo))
+	return
+}
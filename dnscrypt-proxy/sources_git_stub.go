@@ -0,0 +1,13 @@
+// +build !gitsources
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+)
+
+func (source *Source) fetchFromGit(ctx context.Context, srcURL *url.URL, cachedCommit string) ([]byte, []byte, *url.URL, error) {
+	return nil, nil, nil, errors.New("Git URLs are not supported by this build, which must be made using the gitsources tag")
+}
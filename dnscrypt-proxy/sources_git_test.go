@@ -0,0 +1,73 @@
+// +build gitsources
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestGitSource(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	teardown, d := setupSourceTest(t)
+	defer teardown()
+	c := check.T(t)
+	keyStr, sign := newTestSigner(t)
+	repo := filepath.Join(d.tempDir, "lists")
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		c.Must(c.Nil(err, "git %s: %s", args[0], out))
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(bin []byte) string {
+		c.Must(c.Nil(ioutil.WriteFile(filepath.Join(repo, "relays.md"), bin, 0644)))
+		c.Must(c.Nil(ioutil.WriteFile(filepath.Join(repo, "relays.md.minisig"), sign(bin), 0644)))
+		git("add", "relays.md", "relays.md.minisig")
+		git("commit", "-q", "-m", "update")
+		return git("rev-parse", "HEAD")
+	}
+	c.Must(c.Nil(exec.Command("git", "init", "-q", repo).Run()))
+	first := []byte("## relay-1\nsdns://gRIxMzcuNzQuMjIzLjIzNDo0NDM\n")
+	firstCommit := commit(first)
+
+	store := NewMemoryCacheStore()
+	srcURL := "git+file://" + repo + "?path=relays.md"
+	source, err := NewSource("git", d.xTransport, []string{srcURL}, []string{keyStr}, "git.md", "v2", DefaultPrefetchDelay*3, SourceOptions{CacheStore: store})
+	c.Must(c.Nil(err, "Unexpected error"))
+	c.DeepEqual(source.in, first)
+	c.EQ(source.cachedCommit(), firstCommit, "Commit of the cached copy not recorded")
+
+	c.Nil(store.Touch("git.md", d.timeOld))
+	_, err = source.Refresh(context.Background(), d.xTransport)
+	c.Nil(err, "Unexpected error refreshing an unchanged repository")
+	c.DeepEqual(source.in, first)
+
+	second := []byte("## relay-2\nsdns://gRIxMzcuNzQuMjIzLjIzNDo0NDM\n")
+	secondCommit := commit(second)
+	c.Nil(store.Touch("git.md", d.timeOld))
+	_, err = source.Refresh(context.Background(), d.xTransport)
+	c.Nil(err, "Unexpected error")
+	c.DeepEqual(source.in, second, "New commit not loaded")
+	c.EQ(source.cachedCommit(), secondCommit, "Commit of the cached copy not updated")
+
+	pinned, err := NewSource("pinned", d.xTransport, []string{srcURL + "&ref=" + firstCommit}, []string{keyStr}, "pinned.md", "v2", DefaultPrefetchDelay*3,
+		SourceOptions{CacheStore: store})
+	c.Nil(err, "Unexpected error")
+	c.DeepEqual(pinned.in, first, "Commit of the URL not loaded")
+
+	c.Nil(ioutil.WriteFile(filepath.Join(repo, "relays.md"), []byte("## relay-3\nsdns://gRIxMzcuNzQuMjIzLjIzNDo0NDM\n"), 0644))
+	git("commit", "-q", "-a", "-m", "unsigned update")
+	c.Nil(store.Touch("git.md", d.timeOld))
+	_, err = source.Refresh(context.Background(), d.xTransport)
+	c.Match(err, "Invalid signature", "Content of a commit with a stale signature accepted")
+	c.DeepEqual(source.in, second, "Content replaced by a commit with a stale signature")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"golang.org/x/net/idna"
+)
+
+// HostNormalization is applied to the host names in the stamps of the servers of a source, so that the different
+// representations of an internationalized domain name compare equal. Stamps are always dialed with host names in
+// their ASCII form, since that is what TLS, HTTP and DNSCrypt certificate queries use.
+type HostNormalization int
+
+const (
+	HostNormalizationNone    HostNormalization = iota // host names are kept as-is
+	HostNormalizationASCII                            // internationalized host names are converted to their ASCII (punycode) form
+	HostNormalizationUnicode                          // like HostNormalizationASCII, and the Unicode form is kept to be displayed
+)
+
+func parseHostNormalization(str string) (HostNormalization, error) {
+	switch strings.ToLower(str) {
+	case "", "none":
+		return HostNormalizationNone, nil
+	case "ascii", "punycode":
+		return HostNormalizationASCII, nil
+	case "unicode":
+		return HostNormalizationUnicode, nil
+	}
+	return HostNormalizationNone, fmt.Errorf("Unsupported host normalization: [%s]", str)
+}
+
+// isASCII tells if a string only has ASCII characters
+func isASCII(str string) bool {
+	for i := 0; i < len(str); i++ {
+		if str[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeHost converts a host name, optionally followed by a port, to its ASCII or Unicode form. IP addresses are kept as-is.
+// Host names that are already in ASCII form are checked but returned unchanged, so that the case of DNSCrypt provider names is kept.
+func normalizeHost(normalization HostNormalization, addr string) (string, error) {
+	host, port := ExtractHostAndPort(addr, -1)
+	if len(host) == 0 || net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return addr, nil
+	}
+	converted, err := idna.Lookup.ToASCII(host)
+	if err == nil && normalization == HostNormalizationUnicode {
+		converted, err = idna.Lookup.ToUnicode(converted)
+	}
+	if err != nil {
+		return addr, fmt.Errorf("Invalid internationalized host name [%s]: %v", addr, err)
+	}
+	if normalization == HostNormalizationASCII && isASCII(host) {
+		return addr, nil
+	}
+	if port >= 0 {
+		converted += ":" + strconv.Itoa(port)
+	}
+	return converted, nil
+}
+
+// normalizeStampHosts converts the provider name and the address of a stamp to their ASCII form if the source has a host normalization,
+// and returns the provider name or address as listed by the source if it was changed, an empty string otherwise.
+// With HostNormalizationUnicode, the Unicode form of the provider name, or of the address if it has none, is also returned to be displayed.
+func (source *Source) normalizeStampHosts(stamp *stamps.ServerStamp) (originalHost, displayHost string, err error) {
+	if source.options.HostNormalization == HostNormalizationNone {
+		return "", "", nil
+	}
+	for _, addr := range []*string{&stamp.ProviderName, &stamp.ServerAddrStr} {
+		normalized, err := normalizeHost(HostNormalizationASCII, *addr)
+		if err != nil {
+			return "", "", err
+		}
+		if source.options.HostNormalization == HostNormalizationUnicode && len(displayHost) == 0 && len(*addr) > 0 {
+			if displayHost, err = normalizeHost(HostNormalizationUnicode, *addr); err != nil {
+				return "", "", err
+			}
+		}
+		if normalized != *addr && len(originalHost) == 0 {
+			originalHost = *addr
+		}
+		*addr = normalized
+	}
+	return originalHost, displayHost, nil
+}
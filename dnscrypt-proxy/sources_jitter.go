@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// MaxFreshnessJitter is the largest fraction of the cache TTL and the refresh delay of a source that FreshnessJitter can remove
+const MaxFreshnessJitter = 0.5
+
+// machineIDFiles hold a stable identifier of the host, used as the instance ID if the InstanceID option is not set
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// instanceID returns the configured instance ID, or the machine ID, or the host name if there is no machine ID
+func instanceID(configured string) string {
+	if len(configured) > 0 {
+		return configured
+	}
+	for _, file := range machineIDFiles {
+		if bin, err := ioutil.ReadFile(file); err == nil {
+			if id := strings.TrimSpace(string(bin)); len(id) > 0 {
+				return id
+			}
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		dlog.Debugf("No machine ID or host name to derive the freshness jitter from: %v", err)
+	}
+	return hostname
+}
+
+// freshnessJitter returns how much shorter the cache TTL of a source is made on this instance, up to jitter times ttl.
+// The reduction is derived from the instance ID and the name of the source, so that it is the same at every restart,
+// but differs between instances using the same source, whose cached copies then expire at different times.
+func freshnessJitter(ttl time.Duration, jitter float64, id, name string) time.Duration {
+	hash := sha256.Sum256([]byte(id + "\x00" + name))
+	fraction := float64(binary.BigEndian.Uint64(hash[:8])) / (1 << 64)
+	return time.Duration(float64(ttl) * jitter * fraction)
+}
+
+// applyFreshnessJitter shortens the cache TTL and the refresh delay of the source according to its FreshnessJitter option,
+// so that instances refreshing the source periodically don't do it in sync either
+func (source *Source) applyFreshnessJitter() error {
+	jitter := source.options.FreshnessJitter
+	if jitter < 0 || jitter > MaxFreshnessJitter {
+		return fmt.Errorf("Invalid freshness jitter for source [%s]: %v, expected a fraction between 0 and %v", source.name, jitter, MaxFreshnessJitter)
+	}
+	if jitter == 0 {
+		return nil
+	}
+	id := instanceID(source.options.InstanceID)
+	reduction := freshnessJitter(source.cacheTTL, jitter, id, source.name)
+	source.cacheTTL -= reduction
+	source.prefetchDelay -= freshnessJitter(source.prefetchDelay, jitter, id, source.name)
+	dlog.Debugf("Source [%s] cache TTL shortened by %v on this instance, to %v, and refresh delay to %v", source.name, reduction.Round(time.Second),
+		source.cacheTTL.Round(time.Second), source.prefetchDelay.Round(time.Second))
+	return nil
+}
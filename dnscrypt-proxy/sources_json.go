@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// jsonServer is an entry of a JSON source, which is an array of such entries, with the same fields as YAML sources:
+//
+//	[{"name": "example-server", "stamp": "sdns://...", "description": "An example server", "tags": ["dnssec", "no-log"]}]
+type jsonServer struct {
+	Name        string   `json:"name"`
+	Stamp       string   `json:"stamp"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// skipJSONHeader skips the lines starting with "#" before the JSON array, such as a "## .format json" directive
+func skipJSONHeader(bin []byte) []byte {
+	for {
+		trimmed := bytes.TrimLeft(bin, " \t\r\n")
+		if !bytes.HasPrefix(trimmed, []byte("#")) {
+			return trimmed
+		}
+		idx := bytes.IndexByte(trimmed, '\n')
+		if idx < 0 {
+			return nil
+		}
+		bin = trimmed[idx+1:]
+	}
+}
+
+func (source *Source) scanJSON(bin []byte, prefix string) ([]sourceEntry, error) {
+	var servers []jsonServer
+	decoder := json.NewDecoder(bytes.NewReader(skipJSONHeader(bin)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&servers); err != nil {
+		return nil, fmt.Errorf("Invalid JSON in source [%s]: %v", source.name, err)
+	}
+	entries := make([]sourceEntry, 0, len(servers))
+	for i, server := range servers {
+		if len(server.Name) == 0 {
+			return entries, fmt.Errorf("Entry #%d of source [%s] has no name", i, source.name)
+		}
+		entries = append(entries, sourceEntry{
+			name: prefix + server.Name, stampStr: server.Stamp, description: server.Description, tags: server.Tags,
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SourceDefinition holds the parameters of a source to be created by LoadSources
+type SourceDefinition struct {
+	Name         string
+	URLs         []string
+	MinisignKeys []string
+	CacheFile    string
+	Format       string
+	RefreshDelay time.Duration
+	Options      SourceOptions
+}
+
+// ValidateCacheFiles returns an error for each definition whose cache file is already used by a previous one, keyed by name.
+// Sources sharing a cache file would overwrite each other's content and signature, and fail to verify each other's copy.
+// Cache files are compared after the expansion of environment variables with ExpandEnv, and their derivation by the CacheKey
+// option of the definitions.
+func ValidateCacheFiles(defs []SourceDefinition) map[string]error {
+	errs := make(map[string]error)
+	owners := make(map[string]string)
+	for _, def := range defs {
+		if len(def.CacheFile) == 0 {
+			continue
+		}
+		keys := make([]sourceKey, 0, len(def.MinisignKeys))
+		for _, keyStr := range def.MinisignKeys {
+			if key, err := parseSourceKey(keyStr); err == nil {
+				keys = append(keys, key)
+			}
+		}
+		cacheFile := def.CacheFile
+		if def.Options.ExpandEnv {
+			cacheFile = os.ExpandEnv(cacheFile)
+		}
+		cacheFile = deriveCacheFile(cacheFile, keys, def.Options)
+		path, err := filepath.Abs(cacheFile)
+		if err != nil {
+			path = filepath.Clean(cacheFile)
+		}
+		if owner, ok := owners[path]; ok {
+			errs[def.Name] = fmt.Errorf("Source [%s] uses the same cache file [%s] as source [%s]", def.Name, cacheFile, owner)
+			continue
+		}
+		owners[path] = def.Name
+	}
+	return errs
+}
+
+// LoadSources creates and loads the sources concurrently, using up to workers goroutines.
+// Sources are returned in the order of their definitions, as returned by NewSource. A source that
+// fails to load doesn't prevent the others from loading: its error is stored in errs, keyed by name.
+// Once ctx is canceled, downloads in progress are aborted and the remaining sources are not loaded.
+// Sources using the cache file of a previous definition are not loaded, see ValidateCacheFiles.
+// Skipped sources are nil in the returned slice, and their error in errs is the one of ValidateCacheFiles or of ctx.
+func LoadSources(ctx context.Context, xTransport *XTransport, defs []SourceDefinition, workers int) (sources []*Source, errs map[string]error) {
+	if workers < 1 {
+		workers = 1
+	}
+	sources, errs = make([]*Source, len(defs)), ValidateCacheFiles(defs)
+	var errsLock sync.Mutex
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(defs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				def := &defs[i]
+				errsLock.Lock()
+				_, duplicate := errs[def.Name]
+				errsLock.Unlock()
+				if duplicate {
+					continue
+				}
+				err := ctx.Err()
+				if err == nil {
+					sources[i], err = newSource(ctx, def.Name, xTransport, def.URLs, def.MinisignKeys, def.CacheFile, def.Format, def.RefreshDelay, def.Options)
+				}
+				if err != nil {
+					errsLock.Lock()
+					errs[def.Name] = err
+					errsLock.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range defs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return
+}
+
+// DryRunSource downloads, verifies and parses a source once, entirely in memory, to check a definition against its mirrors
+// before adding it to the configuration. The cache file of the definition is never read nor written, bundled copies and
+// the Approve hook are ignored, and the source is discarded afterwards, so that nothing is persisted or scheduled.
+// Once ctx is canceled, downloads in progress are aborted.
+func DryRunSource(ctx context.Context, xTransport *XTransport, def SourceDefinition, prefix string) ([]RegisteredServer, error) {
+	options := def.Options
+	options.CacheStore = NewMemoryCacheStore()
+	options.Offline, options.Approve = false, nil
+	options.SeedFile, options.Seed, options.SeedSignature = "", nil, nil
+	cacheFile := def.CacheFile
+	if len(cacheFile) == 0 {
+		cacheFile = def.Name
+	}
+	source, err := newSource(ctx, def.Name, xTransport, def.URLs, def.MinisignKeys, cacheFile, def.Format, def.RefreshDelay, options)
+	if err != nil {
+		return []RegisteredServer{}, err
+	}
+	return source.Parse(prefix)
+}
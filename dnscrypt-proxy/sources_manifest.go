@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/jedisct1/go-minisign"
+)
+
+// KeyManifestRootKey is the Minisign public key key manifests must be signed with, and their only trust anchor.
+// It is empty unless it is set at build time, ex: go build -ldflags "-X main.KeyManifestRootKey=RWQ..."
+var KeyManifestRootKey string
+
+// keyManifestSuffix is added to the cache file of a source to get the cached copy of its key manifest
+const keyManifestSuffix = ".keys"
+
+// parseKeyManifest returns the keys listed in a key manifest, one per line, with the same syntax as configured keys.
+// Empty lines and lines starting with '#' are skipped.
+func parseKeyManifest(bin []byte) ([]sourceKey, error) {
+	var keys []sourceKey
+	for i, line := range strings.Split(string(bin), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := parseSourceKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key at line %d of the key manifest: %v", i+1, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Empty key manifest")
+	}
+	return keys, nil
+}
+
+// verifyKeyManifest checks the signature of a key manifest with the root key, and returns its keys
+func verifyKeyManifest(bin, sig []byte) ([]sourceKey, error) {
+	if len(KeyManifestRootKey) == 0 {
+		return nil, fmt.Errorf("This build has no root key to verify key manifests")
+	}
+	rootKey, err := decodePublicKey(KeyManifestRootKey)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid root key for key manifests: %v", err)
+	}
+	signature, err := minisign.DecodeSignature(string(sig))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = rootKey.Verify(bin, signature); err != nil {
+		return nil, err
+	}
+	return parseKeyManifest(bin)
+}
+
+// checkKeyManifestReplay rejects a verified key manifest signed before the last one accepted, according to the timestamps
+// of their trusted comments, so that an older manifest listing keys that have since been removed can't be served again.
+// It returns the timestamp of the manifest, zero if it has none, which is only accepted if no timestamp was recorded.
+func (source *Source) checkKeyManifestReplay(sig []byte) (time.Time, error) {
+	timestamp, err := signatureTimestamp(sig)
+	if err != nil {
+		timestamp = time.Time{}
+	}
+	meta, metaErr := source.readMetadata()
+	if metaErr != nil {
+		return timestamp, metaErr
+	}
+	if meta.KeyManifestTimestamp == 0 {
+		return timestamp, nil
+	}
+	accepted := time.Unix(meta.KeyManifestTimestamp, 0)
+	if err != nil {
+		return timestamp, fmt.Errorf("Key manifest has no valid timestamp, while the last one accepted was signed on %v: %v", accepted, err)
+	}
+	if timestamp.Before(accepted) {
+		return timestamp, fmt.Errorf("Key manifest signed on %v is older than the last one accepted, signed on %v", timestamp, accepted)
+	}
+	return timestamp, nil
+}
+
+// recordKeyManifestTimestamp stores the timestamp of an accepted key manifest in the metadata of the source
+func (source *Source) recordKeyManifestTimestamp(timestamp time.Time) {
+	if timestamp.IsZero() {
+		return
+	}
+	meta, err := source.readMetadata()
+	if err == nil && meta.KeyManifestTimestamp == timestamp.Unix() {
+		return
+	}
+	if err == nil {
+		meta.KeyManifestTimestamp = timestamp.Unix()
+		err = source.writeMetadata(meta)
+	}
+	if err != nil {
+		dlog.Warnf("Source [%s] key manifest timestamp couldn't be recorded: %v", source.name, err)
+	}
+}
+
+// loadKeyManifest downloads the key manifest of the source and returns its keys once verified.
+// The verified manifest is cached next to the source, and the cached copy is used if it can't be downloaded.
+// Manifests older than the last one accepted are rejected, see checkKeyManifestReplay.
+func (source *Source) loadKeyManifest(ctx context.Context, xTransport *XTransport) ([]sourceKey, error) {
+	manifestURL := source.options.KeyManifestURL
+	if source.options.ExpandEnv {
+		var err error
+		if manifestURL, err = source.expandEnv("key manifest URL", manifestURL); err != nil {
+			return nil, err
+		}
+	}
+	u, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key manifest URL for source [%s]: %v", source.name, err)
+	}
+	store := source.cacheStore()
+	cacheFile := source.cacheFile + keyManifestSuffix
+	sigCacheFile := cacheFile + source.signatureSuffix()
+	var keys []sourceKey
+	var timestamp time.Time
+	if !source.options.Offline {
+		var bin, sig []byte
+		if bin, err = source.fetchFromURL(ctx, xTransport, u); err == nil {
+			sigURL := signatureURL(u, source.signatureSuffix(), source.options.SignatureAfterQuery)
+			if sig, err = source.fetchFromURL(ctx, xTransport, sigURL); err == nil {
+				if keys, err = verifyKeyManifest(bin, sig); err == nil {
+					timestamp, err = source.checkKeyManifestReplay(sig)
+				}
+			}
+		}
+		if err == nil {
+			source.recordKeyManifestTimestamp(timestamp)
+			writeErr := store.Write(ctx, cacheFile, bin)
+			if writeErr == nil {
+				writeErr = store.Write(ctx, sigCacheFile, sig)
+			}
+			if writeErr != nil {
+				dlog.Warnf("Source [%s] key manifest couldn't be cached: %v", source.name, writeErr)
+			}
+			dlog.Debugf("Source [%s] loaded %d keys from the key manifest at [%s]", source.name, len(keys), redactedURL(u))
+			return keys, nil
+		}
+		dlog.Warnf("Source [%s] key manifest couldn't be loaded from [%s]: %v", source.name, redactedURL(u), err)
+	}
+	downloadErr := err
+	bin, err := store.Read(cacheFile)
+	var sig []byte
+	if err == nil {
+		sig, err = store.Read(sigCacheFile)
+	}
+	if err != nil {
+		if downloadErr != nil {
+			err = downloadErr // more useful than the missing cache file
+		}
+		return nil, fmt.Errorf("Source [%s] has no valid key manifest: %v", source.name, err)
+	}
+	if keys, err = verifyKeyManifest(bin, sig); err == nil {
+		timestamp, err = source.checkKeyManifestReplay(sig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Source [%s] cached key manifest is invalid: %v", source.name, err)
+	}
+	source.recordKeyManifestTimestamp(timestamp)
+	dlog.Debugf("Source [%s] loaded %d keys from the cached key manifest", source.name, len(keys))
+	return keys, nil
+}
+
+// refreshKeyManifest replaces the keys of the source that came from its key manifest, keeping them if it can't be loaded
+func (source *Source) refreshKeyManifest(ctx context.Context, xTransport *XTransport) {
+	keys, err := source.loadKeyManifest(ctx, xTransport)
+	if err != nil {
+		dlog.Warnf("Source [%s] keeps using its current keys: %v", source.name, err)
+		return
+	}
+	source.setKeys(append(source.minisignKeys[:source.configKeys:source.configKeys], keys...))
+}
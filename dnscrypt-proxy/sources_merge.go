@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jedisct1/dlog"
+)
+
+// MergePolicy decides which entry is kept when the same server name is listed by several sources
+type MergePolicy int
+
+const (
+	MergeErrorOnConflict MergePolicy = iota // fail if a server name is listed by more than one source
+	MergeFirstWins                          // keep the entry of the first source listing a name
+	MergeLastWins                           // keep the entry of the last source listing a name
+	MergePriority                           // keep the entry of the source with the highest Priority, the first one on ties
+)
+
+// MergeSources parses the sources, in order, and merges their servers into a single list, resolving name conflicts
+// according to policy. Prefixes are not applied, so that the same servers can be matched across sources.
+// Servers keep the position at which their name first appeared. The sources are left as they are, as if Parse wasn't called.
+func MergeSources(sources []*Source, policy MergePolicy) ([]RegisteredServer, error) {
+	var merged []RegisteredServer
+	indexes := make(map[string]int)
+	owners := make(map[string]*Source)
+	for _, source := range sources {
+		registeredServers, err := source.parse(source.in, "")
+		if err != nil {
+			if len(registeredServers) == 0 {
+				return []RegisteredServer{}, fmt.Errorf("Unable to use source [%s]: [%v]", source.name, err)
+			}
+			dlog.Warnf("Error in source [%s]: [%s] -- Continuing with reduced server count [%d]", source.name, err, len(registeredServers))
+		}
+		for _, registeredServer := range registeredServers {
+			i, ok := indexes[registeredServer.name]
+			if !ok {
+				indexes[registeredServer.name] = len(merged)
+				owners[registeredServer.name] = source
+				merged = append(merged, registeredServer)
+				continue
+			}
+			owner := owners[registeredServer.name]
+			override := false
+			switch policy {
+			case MergeErrorOnConflict:
+				return []RegisteredServer{}, fmt.Errorf("Server [%s] is listed by both source [%s] and source [%s]", registeredServer.name, owner.name, source.name)
+			case MergeFirstWins:
+			case MergeLastWins:
+				override = true
+			case MergePriority:
+				override = source.options.Priority > owner.options.Priority
+			default:
+				return []RegisteredServer{}, fmt.Errorf("Unsupported merge policy: %d", policy)
+			}
+			if !override {
+				dlog.Debugf("Server [%s] from source [%s] ignored, already listed by source [%s]", registeredServer.name, source.name, owner.name)
+				continue
+			}
+			dlog.Noticef("Server [%s] from source [%s] overridden by source [%s]", registeredServer.name, owner.name, source.name)
+			merged[i] = registeredServer
+			owners[registeredServer.name] = source
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/url"
+	"time"
+)
+
+// MirrorStats summarizes the recent downloads of the content of a source from one of its URLs
+type MirrorStats struct {
+	URL            string
+	Fetches        uint64        // successful downloads
+	Failures       uint64        // failed downloads
+	LastLatency    time.Duration // duration of the last successful download
+	AverageLatency time.Duration // average duration of the last MirrorStatsWindow successful downloads
+}
+
+// mirrorHistory keeps the durations of the last successful downloads from a URL in a ring buffer
+type mirrorHistory struct {
+	latencies         []time.Duration
+	next              int
+	fetches, failures uint64
+}
+
+// recordMirrorFetch records how long downloading the content of the source from u took, if MirrorStatsWindow is set
+func (source *Source) recordMirrorFetch(u *url.URL, latency time.Duration, err error) {
+	window := source.options.MirrorStatsWindow
+	if window <= 0 {
+		return
+	}
+	source.statsLock.Lock()
+	defer source.statsLock.Unlock()
+	if source.mirrors == nil {
+		source.mirrors = make(map[string]*mirrorHistory)
+	}
+	history, ok := source.mirrors[u.String()]
+	if !ok {
+		history = &mirrorHistory{latencies: make([]time.Duration, 0, window)}
+		source.mirrors[u.String()] = history
+	}
+	if err != nil {
+		history.failures++
+		return
+	}
+	history.fetches++
+	if len(history.latencies) < window {
+		history.latencies = append(history.latencies, latency)
+	} else {
+		history.latencies[history.next] = latency
+	}
+	history.next = (history.next + 1) % window
+}
+
+// pruneMirrors forgets the history of URLs that are not in urls anymore, so that replacing URLs doesn't grow it unbounded
+func (source *Source) pruneMirrors(urls []*url.URL) {
+	current := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		current[u.String()] = true
+	}
+	source.statsLock.Lock()
+	for urlStr := range source.mirrors {
+		if !current[urlStr] {
+			delete(source.mirrors, urlStr)
+		}
+	}
+	source.statsLock.Unlock()
+}
+
+// MirrorStats returns the recent download statistics of each URL of the source, in the order of its URLs.
+// Only downloads made since the source was created with MirrorStatsWindow set are counted.
+func (source *Source) MirrorStats() []MirrorStats {
+	source.statsLock.Lock()
+	defer source.statsLock.Unlock()
+	stats := make([]MirrorStats, 0, len(source.status.urls))
+	for _, urlStr := range source.status.urls {
+		mirror := MirrorStats{URL: urlStr}
+		if history, ok := source.mirrors[mirror.URL]; ok {
+			mirror.Fetches, mirror.Failures = history.fetches, history.failures
+			if n := len(history.latencies); n > 0 {
+				mirror.LastLatency = history.latencies[(history.next+n-1)%n]
+				var total time.Duration
+				for _, latency := range history.latencies {
+					total += latency
+				}
+				mirror.AverageLatency = total / time.Duration(n)
+			}
+		}
+		stats = append(stats, mirror)
+	}
+	return stats
+}
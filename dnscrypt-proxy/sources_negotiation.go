@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// formatMediaTypes are the media types of the formats of sources, the first one being sent in Accept headers
+var formatMediaTypes = map[string][]string{
+	"v2":   {"text/markdown", "text/x-markdown"},
+	"yaml": {"application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml"},
+	"json": {"application/json"},
+}
+
+// acceptHeader returns the Accept header listing the AcceptFormats of the source in order of preference, or nil without AcceptFormats
+func (source *Source) acceptHeader() http.Header {
+	if len(source.options.AcceptFormats) == 0 {
+		return nil
+	}
+	accepted := make([]string, 0, len(source.options.AcceptFormats))
+	for i, formatStr := range source.options.AcceptFormats {
+		mediaType := formatMediaTypes[formatStr][0]
+		if i > 0 {
+			mediaType += fmt.Sprintf(";q=0.%d", 9-i)
+		}
+		accepted = append(accepted, mediaType)
+	}
+	return http.Header{"Accept": {strings.Join(accepted, ", ")}}
+}
+
+// negotiatedFormatStr returns the format of a download according to its Content-Type, if it is one of AcceptFormats.
+// An empty string is returned if the server didn't negotiate, so that the configured format is used.
+func (source *Source) negotiatedFormatStr(respHeader http.Header) string {
+	if len(source.options.AcceptFormats) == 0 {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(respHeader.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	for _, formatStr := range source.options.AcceptFormats {
+		for _, formatMediaType := range formatMediaTypes[formatStr] {
+			if mediaType == formatMediaType {
+				return formatStr
+			}
+		}
+	}
+	return ""
+}
+
+// formatOf returns the format used to parse content whose format was negotiated as formatStr, the configured format if it is empty
+func (source *Source) formatOf(formatStr string) SourceFormat {
+	if format, err := parseSourceFormat(formatStr); len(formatStr) > 0 && err == nil {
+		return format
+	}
+	return source.format
+}
+
+// checkAcceptFormats checks that the AcceptFormats of the source are all supported, and listed once
+func (source *Source) checkAcceptFormats() error {
+	if len(source.options.AcceptFormats) > 9 {
+		return fmt.Errorf("Source [%s] accepts too many formats", source.name)
+	}
+	seen := make(map[string]bool)
+	for _, formatStr := range source.options.AcceptFormats {
+		if _, err := parseSourceFormat(formatStr); err != nil {
+			return fmt.Errorf("Source [%s]: %v", source.name, err)
+		}
+		if seen[formatStr] {
+			return fmt.Errorf("Source [%s] accepts format [%s] twice", source.name, formatStr)
+		}
+		seen[formatStr] = true
+	}
+	return nil
+}
+
+// cachedFormat returns the format negotiated for the cached copy of the source, recorded in its metadata
+func (source *Source) cachedFormat() (string, error) {
+	if len(source.options.AcceptFormats) == 0 {
+		return "", nil
+	}
+	meta, err := source.readMetadata()
+	if err != nil {
+		return "", err
+	}
+	return meta.Format, nil
+}
+
+// recordNegotiatedFormat sets the format negotiated for new content, and records it in the metadata of the cached copy
+func (source *Source) recordNegotiatedFormat(formatStr string) error {
+	if len(source.options.AcceptFormats) == 0 {
+		return nil
+	}
+	source.negotiatedFormat = formatStr
+	meta, err := source.readMetadata()
+	if err != nil {
+		return err
+	}
+	if meta.Format == formatStr {
+		return nil
+	}
+	meta.Format = formatStr
+	return source.writeMetadata(meta)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/jedisct1/dlog"
+)
+
+// overrideRemovalPrefix starts the names of the entries of override files that remove a server instead of changing it
+const overrideRemovalPrefix = "-"
+
+// sourceOverrides are the changes made to the servers of a source by its OverrideFile
+type sourceOverrides struct {
+	entries  []sourceEntry // servers to change, or to add if they have a stamp and are not listed by the source
+	removals []string      // names of the servers to remove
+}
+
+// scanOverrides splits an override file into entries. Override files use the V2 format, including its comments, except
+// that entries can have no stamp, to only change the description of a server, and no lines at all when their name starts
+// with overrideRemovalPrefix.
+func (source *Source) scanOverrides(bin []byte, prefix string) (sourceOverrides, error) {
+	var overrides sourceOverrides
+	parts := strings.Split(string(bin), "## ")
+	for _, part := range parts[1:] {
+		subparts := strings.Split(strings.TrimFunc(part, unicode.IsSpace), "\n")
+		name := strings.TrimFunc(subparts[0], unicode.IsSpace)
+		if strings.HasPrefix(name, overrideRemovalPrefix) {
+			name = strings.TrimFunc(strings.TrimPrefix(name, overrideRemovalPrefix), unicode.IsSpace)
+			if len(name) == 0 {
+				return overrides, fmt.Errorf("Missing name of a server to remove")
+			}
+			overrides.removals = append(overrides.removals, prefix+name)
+			continue
+		}
+		if len(name) == 0 {
+			return overrides, fmt.Errorf("Missing name of a server to override")
+		}
+		entry := sourceEntry{name: prefix + name}
+		for _, subpart := range subparts[1:] {
+			subpart = strings.TrimFunc(subpart, unicode.IsSpace)
+			if strings.HasPrefix(subpart, "sdns:") {
+				if len(entry.stampStr) > 0 {
+					return overrides, fmt.Errorf("Multiple stamps for server [%s]", entry.name)
+				}
+				entry.stampStr = subpart
+				continue
+			} else if len(subpart) == 0 || source.isComment(subpart) {
+				continue
+			}
+			if len(entry.description) > 0 {
+				entry.description += "\n"
+			}
+			entry.description += subpart
+		}
+		overrides.entries = append(overrides.entries, entry)
+	}
+	return overrides, nil
+}
+
+// loadOverrides reads the OverrideFile of the source, and checks its signature with the OverrideKeys of the source, or
+// with its own keys if there are none. A missing signature is only accepted with OverrideUnsigned.
+func (source *Source) loadOverrides(prefix string) (sourceOverrides, error) {
+	file := source.options.OverrideFile
+	bin, err := ioutil.ReadFile(file)
+	if err != nil {
+		return sourceOverrides{}, err
+	}
+	sig, err := ioutil.ReadFile(file + source.signatureSuffix())
+	if err == nil {
+		if len(source.overrideKeys) > 0 {
+			err = (&Source{name: source.name, minisignKeys: source.overrideKeys}).checkMinisignSignature(bin, sig)
+		} else {
+			err = source.checkSignature(bin, sig)
+		}
+		if err != nil {
+			return sourceOverrides{}, fmt.Errorf("Invalid signature: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return sourceOverrides{}, err
+	} else if !source.options.OverrideUnsigned {
+		return sourceOverrides{}, fmt.Errorf("Missing signature [%s] - If the changes are trusted without one, set `override_unsigned = true`", file+source.signatureSuffix())
+	} else {
+		dlog.Warnf("Overrides [%s] of source [%s] are not signed", file, source.name)
+	}
+	return source.scanOverrides(bin, prefix)
+}
+
+// overrideStamp changes the stamp of a server to the one of an override entry, checked like the stamps of the source
+func (source *Source) overrideStamp(registeredServer *RegisteredServer, stampStr string) error {
+	stamp, err := ValidateStamp(stampStr)
+	if err != nil {
+		return err
+	}
+	if err = source.checkRole(stamp); err != nil {
+		return err
+	}
+	if registeredServer.originalHost, registeredServer.displayHost, err = source.normalizeStampHosts(&stamp); err != nil {
+		return err
+	}
+	registeredServer.stamp = stamp
+	if source.options.DescribeServers {
+		descriptor := NewServerDescriptor(stamp)
+		registeredServer.descriptor = &descriptor
+	}
+	return nil
+}
+
+// applyOverrides merges the OverrideFile of the source, if any, onto its parsed servers. Every change is logged.
+// No servers are returned if the overrides can't be applied, so that servers meant to be removed are never used.
+func (source *Source) applyOverrides(registeredServers []RegisteredServer, prefix string) ([]RegisteredServer, error) {
+	if len(source.options.OverrideFile) == 0 {
+		return registeredServers, nil
+	}
+	file := source.options.OverrideFile
+	overrides, err := source.loadOverrides(prefix)
+	if err != nil {
+		return []RegisteredServer{}, fmt.Errorf("Unable to apply the overrides [%s] of source [%s]: %v", file, source.name, err)
+	}
+	indexes := make(map[string]int, len(registeredServers))
+	for i, registeredServer := range registeredServers {
+		indexes[registeredServer.name] = i
+	}
+	for _, entry := range overrides.entries {
+		if entry.name, err = source.normalizeName(entry.name); err != nil {
+			return []RegisteredServer{}, fmt.Errorf("Unable to apply the overrides [%s] of source [%s]: %v", file, source.name, err)
+		}
+		i, ok := indexes[entry.name]
+		if !ok {
+			if len(entry.stampStr) == 0 {
+				dlog.Warnf("Override of server [%s] in [%s] ignored: source [%s] doesn't list it, and the override has no stamp", entry.name, file, source.name)
+				continue
+			}
+			if source.filtered(entry.name) {
+				continue
+			}
+			i = len(registeredServers)
+			indexes[entry.name] = i
+			registeredServers = append(registeredServers, RegisteredServer{name: entry.name, tags: source.options.Tags, role: source.options.Role})
+			dlog.Noticef("Server [%s] added to source [%s] by [%s]", entry.name, source.name, file)
+		}
+		if len(entry.stampStr) > 0 {
+			if err = source.overrideStamp(&registeredServers[i], entry.stampStr); err != nil {
+				return []RegisteredServer{}, fmt.Errorf("Unable to apply the overrides [%s] of source [%s]: invalid stamp for server [%s]: %v", file, source.name, entry.name, err)
+			}
+			if ok {
+				dlog.Noticef("Stamp of server [%s] of source [%s] overridden by [%s]", entry.name, source.name, file)
+			}
+		}
+		if len(entry.description) > 0 {
+			registeredServers[i].description = entry.description
+			if ok {
+				dlog.Noticef("Description of server [%s] of source [%s] overridden by [%s]", entry.name, source.name, file)
+			}
+		}
+	}
+	if len(overrides.removals) == 0 {
+		return registeredServers, nil
+	}
+	removed := make(map[string]bool, len(overrides.removals))
+	for _, name := range overrides.removals {
+		if name, err = source.normalizeName(name); err != nil {
+			return []RegisteredServer{}, fmt.Errorf("Unable to apply the overrides [%s] of source [%s]: %v", file, source.name, err)
+		}
+		if _, ok := indexes[name]; !ok {
+			dlog.Warnf("Removal of server [%s] in [%s] ignored: source [%s] doesn't list it", name, file, source.name)
+			continue
+		}
+		removed[name] = true
+	}
+	kept := registeredServers[:0]
+	for _, registeredServer := range registeredServers {
+		if removed[registeredServer.name] {
+			dlog.Noticef("Server [%s] removed from source [%s] by [%s]", registeredServer.name, source.name, file)
+			continue
+		}
+		kept = append(kept, registeredServer)
+	}
+	return kept, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+)
+
+// Pin freezes the source at the content with the given hexadecimal SHA-256 hash, the hash of the file as downloaded.
+// Updates with a valid signature are still downloaded and verified, but rejected if they have a different hash,
+// and the current content keeps being used until Unpin is called or another hash is pinned.
+func (source *Source) Pin(hash string) error {
+	pinned, err := hex.DecodeString(strings.TrimSpace(hash))
+	if err != nil || len(pinned) != sha256.Size {
+		return fmt.Errorf("Invalid SHA-256 hash to pin source [%s] to: [%s]", source.name, hash)
+	}
+	source.statsLock.Lock()
+	source.pinnedHash = pinned
+	source.statsLock.Unlock()
+	dlog.Noticef("Source [%s] pinned to the content with hash [%s]", source.name, hex.EncodeToString(pinned))
+	return nil
+}
+
+// Unpin lets updates of the source replace its content again, from the next refresh
+func (source *Source) Unpin() {
+	source.statsLock.Lock()
+	pinned := source.pinnedHash
+	source.pinnedHash = nil
+	source.statsLock.Unlock()
+	if pinned != nil {
+		dlog.Noticef("Source [%s] unpinned, updates are accepted again", source.name)
+	}
+}
+
+// PinnedHash returns the hash the source is pinned to, or an empty string if it isn't pinned
+func (source *Source) PinnedHash() string {
+	source.statsLock.Lock()
+	defer source.statsLock.Unlock()
+	if source.pinnedHash == nil {
+		return ""
+	}
+	return hex.EncodeToString(source.pinnedHash)
+}
+
+// checkPin returns an error if the source is pinned and bin, verified content before Transform, doesn't have the pinned hash
+func (source *Source) checkPin(bin []byte) error {
+	source.statsLock.Lock()
+	pinned := source.pinnedHash
+	source.statsLock.Unlock()
+	if pinned == nil {
+		return nil
+	}
+	if hash := sha256.Sum256(bin); !bytes.Equal(hash[:], pinned) {
+		return fmt.Errorf("Source [%s] content with hash [%s] doesn't match the pinned hash [%s]", source.name, hex.EncodeToString(hash[:]), hex.EncodeToString(pinned))
+	}
+	return nil
+}
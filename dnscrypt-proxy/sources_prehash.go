@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jedisct1/go-minisign"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Minisign signs either the content itself (legacy signatures, algorithm "Ed"), or its BLAKE2b-512 hash (prehashed
+// signatures, algorithm "ED", the default since minisign 0.9). Both are made with the same Ed25519 keys.
+//
+// A legacy signature can only be verified with the whole content in memory: Ed25519 hashes the content after a value
+// taken from the signature, so nothing can be computed before the signature has been downloaded. A prehashed signature
+// only needs the 64-byte hash, which could be computed as the content is downloaded.
+//
+// Downloads are still read into a single buffer, since the content is needed to be parsed and cached anyway, and
+// verification doesn't copy that buffer with either algorithm, so hashing as the content is downloaded would bring no
+// memory saving.
+var (
+	legacySignatureAlgorithm    = [2]byte{'E', 'd'}
+	prehashedSignatureAlgorithm = [2]byte{'E', 'D'}
+)
+
+// contentDigest computes the hash of content signed with a prehashed signature
+type contentDigest struct {
+	sum []byte
+}
+
+func digestContent(bin []byte) contentDigest {
+	sum := blake2b.Sum512(bin)
+	return contentDigest{sum: sum[:]}
+}
+
+// verifyPrehashed checks a prehashed signature, like minisign.PublicKey.Verify does with legacy signatures
+func verifyPrehashed(key *minisign.PublicKey, digest contentDigest, signature minisign.Signature) error {
+	if key.SignatureAlgorithm != legacySignatureAlgorithm {
+		return errors.New("Incompatible signature algorithm")
+	}
+	if key.KeyId != signature.KeyId {
+		return errors.New("Incompatible key identifiers")
+	}
+	if !strings.HasPrefix(signature.TrustedComment, "trusted comment: ") {
+		return errors.New("Unexpected format for the trusted comment")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key.PublicKey[:]), digest.sum, signature.Signature[:]) {
+		return errors.New("Invalid signature")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key.PublicKey[:]), append(signature.Signature[:], signature.TrustedComment[17:]...), signature.GlobalSignature[:]) {
+		return errors.New("Invalid global signature")
+	}
+	return nil
+}
+
+// verifyWithKey checks a legacy or prehashed signature of bin. The hash of bin is only computed once for all the keys.
+func verifyWithKey(key *minisign.PublicKey, bin []byte, digest *contentDigest, signature minisign.Signature) error {
+	if signature.SignatureAlgorithm != prehashedSignatureAlgorithm {
+		_, err := key.Verify(bin, signature)
+		return err
+	}
+	if digest.sum == nil {
+		*digest = digestContent(bin)
+	}
+	return verifyPrehashed(key, *digest, signature)
+}
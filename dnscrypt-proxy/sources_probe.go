@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// URLHealth is the result of probing a URL of a source
+type URLHealth struct {
+	URL        string
+	StatusCode int           // set if the server responded with an unsuccessful status code
+	Latency    time.Duration // time until the response was received, or until the probe failed
+	Err        error         // nil if the URL is reachable
+}
+
+// Probe checks that the URLs of the source are reachable, without downloading them, nor changing the state of the source.
+// A HEAD request is sent to each URL, falling back to a GET request for a single byte if HEAD is not supported.
+// The body of the responses is never read, since servers may ignore the range and send the whole content.
+func (source *Source) Probe(ctx context.Context, xTransport *XTransport) []URLHealth {
+	ctx = withHeadersOnly(ctx)
+	health := make([]URLHealth, 0, len(source.urls))
+	for _, u := range source.urls {
+		start := time.Now()
+		_, _, err := source.fetchURL(ctx, xTransport, "HEAD", u, nil)
+		if statusErr, ok := err.(*HTTPStatusError); ok && (statusErr.StatusCode == http.StatusMethodNotAllowed || statusErr.StatusCode == http.StatusNotImplemented) {
+			start = time.Now()
+			_, _, err = source.fetchURL(ctx, xTransport, "GET", u, http.Header{"Range": {"bytes=0-0"}})
+		}
+		result := URLHealth{URL: redactedURL(u), Latency: time.Since(start), Err: err}
+		if statusErr, ok := err.(*HTTPStatusError); ok {
+			result.StatusCode = statusErr.StatusCode
+		}
+		health = append(health, result)
+	}
+	return health
+}
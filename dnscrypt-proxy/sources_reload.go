@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/jedisct1/dlog"
+)
+
+// minServers returns the minimum number of servers new content must list to replace the current content with SafeReload:
+// MinServers, or else the min_servers directive of the new content, or else 1
+func (source *Source) minServers(format SourceFormat, in []byte) int {
+	if source.options.MinServers > 0 {
+		return source.options.MinServers
+	}
+	if format == SourceFormatV2 {
+		if minServers, err := strconv.Atoi(parseV2Directives(string(in))["min_servers"]); err == nil && minServers > 0 {
+			return minServers
+		}
+	}
+	return 1
+}
+
+// checkReload parses verified content before it replaces the current content and the cached copy, with SafeReload, so that
+// an update that can't be used is rejected as a whole. Entries that can't be parsed are tolerated as long as enough servers remain.
+// Archives are rejected if they can't be extracted, or if one of their entries can't be parsed, see checkArchiveParsable.
+func (source *Source) checkReload(formatStr string, in []byte) error {
+	if !source.options.SafeReload {
+		return nil
+	}
+	if source.options.Archive {
+		if err := source.checkArchiveParsable(in); err != nil {
+			err = fmt.Errorf("Source [%s] update can't be used: %v", source.name, err)
+			dlog.Warnf("%v - Keeping the current content", err)
+			return err
+		}
+		return nil
+	}
+	format, err := source.contentFormatAs(formatStr, in)
+	if err != nil {
+		return err
+	}
+	registeredServers, err := source.registerEntries(source.scanEntries(format, in, ""))
+	if minServers := source.minServers(format, in); len(registeredServers) < minServers {
+		if err == nil {
+			err = fmt.Errorf("Source [%s] update lists %d servers, expected at least %d", source.name, len(registeredServers), minServers)
+		} else {
+			err = fmt.Errorf("Source [%s] update lists %d servers, expected at least %d: %v", source.name, len(registeredServers), minServers, err)
+		}
+		dlog.Warnf("%v - Keeping the current content", err)
+		return err
+	}
+	return nil
+}
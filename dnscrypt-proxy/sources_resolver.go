@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// newSourceResolver returns a HostResolver trying the resolvers in order: DNS resolvers given as IP:port, queried over UDP,
+// or TCP if they can't be reached over UDP, or DoH servers given as https:// URLs. A DoH server is reached using the
+// XTransport, so its host name, unless it is an IP address, is resolved like any other name.
+func (xTransport *XTransport) newSourceResolver(resolvers []string) (HostResolver, error) {
+	dohURLs := make(map[string]*url.URL)
+	for _, resolver := range resolvers {
+		if !strings.HasPrefix(resolver, "https://") {
+			if err := isIPAndPort(resolver); err != nil {
+				return nil, fmt.Errorf("Invalid resolver [%s], expected IP:port or a DoH URL: %v", resolver, err)
+			}
+			continue
+		}
+		dohURL, err := url.Parse(resolver)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid DoH resolver URL [%s]: %v", resolver, err)
+		}
+		dohURLs[resolver] = dohURL
+	}
+	return func(ctx context.Context, host string) (net.IP, error) {
+		err := errors.New("No resolvers")
+		for _, resolver := range resolvers {
+			var ip net.IP
+			if dohURL, ok := dohURLs[resolver]; ok {
+				ip, err = xTransport.resolveUsingDoH(dohURL, host)
+			} else {
+				for _, proto := range []string{"udp", "tcp"} {
+					if ip, _, err = xTransport.resolveUsingResolver(proto, host, resolver); err == nil {
+						break
+					}
+				}
+			}
+			if err == nil && ip == nil {
+				err = errors.New("No address found")
+			}
+			if err == nil {
+				dlog.Debugf("[%s] resolved to [%s] using resolver [%s]", host, ip, resolver)
+				return ip, nil
+			}
+			dlog.Debugf("Unable to resolve [%s] using resolver [%s]: %v", host, resolver, err)
+		}
+		return nil, fmt.Errorf("Unable to resolve [%s] using the resolvers of the source: %v", host, err)
+	}, nil
+}
+
+// resolveUsingDoH looks up the IPv4 addresses of host, and its IPv6 addresses if IPv6 is used, with a DoH server
+func (xTransport *XTransport) resolveUsingDoH(dohURL *url.URL, host string) (net.IP, error) {
+	qtypes := []uint16{}
+	if xTransport.useIPv4 {
+		qtypes = append(qtypes, dns.TypeA)
+	}
+	if xTransport.useIPv6 {
+		qtypes = append(qtypes, dns.TypeAAAA)
+	}
+	var err error
+	for _, qtype := range qtypes {
+		msg := dns.Msg{}
+		msg.SetQuestion(dns.Fqdn(host), qtype)
+		msg.Id = 0
+		var query, bin []byte
+		if query, err = msg.Pack(); err != nil {
+			return nil, err
+		}
+		if bin, _, _, err = xTransport.DoHQuery(false, dohURL, query, xTransport.timeout); err != nil {
+			continue
+		}
+		response := dns.Msg{}
+		if err = response.Unpack(bin); err != nil {
+			continue
+		}
+		for _, answer := range response.Answer {
+			switch rr := answer.(type) {
+			case *dns.A:
+				return rr.A, nil
+			case *dns.AAAA:
+				return rr.AAAA, nil
+			}
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,221 @@
+// +build s3sources
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Supported is set in builds made with the s3sources tag
+const s3Supported = true
+
+// s3EmptyPayloadHash is the SHA-256 hash of the empty body of GET and HEAD requests
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type s3Credentials struct {
+	accessKeyID, secretAccessKey, sessionToken string
+}
+
+// loadS3Credentials returns the credentials set in the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// environment variables, or else the ones of the AWS_PROFILE profile (default by default) in the shared credentials file.
+// Requests are sent anonymously if there are none.
+func loadS3Credentials() (s3Credentials, error) {
+	creds := s3Credentials{
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if len(creds.accessKeyID) > 0 {
+		return creds, nil
+	}
+	file := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if len(file) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return creds, nil
+		}
+		file = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if len(profile) == 0 {
+		profile = "default"
+	}
+	creds, err := readS3Profile(file, profile)
+	if os.IsNotExist(err) {
+		return creds, nil
+	}
+	return creds, err
+}
+
+// readS3Profile reads the credentials of a profile from a shared credentials file
+func readS3Profile(file, profile string) (creds s3Credentials, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	found, inProfile := false, false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == profile
+			found = found || inProfile
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if !inProfile || len(parts) != 2 {
+			continue
+		}
+		switch value := strings.TrimSpace(parts[1]); strings.TrimSpace(parts[0]) {
+		case "aws_access_key_id":
+			creds.accessKeyID = value
+		case "aws_secret_access_key":
+			creds.secretAccessKey = value
+		case "aws_session_token":
+			creds.sessionToken = value
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if !found {
+		err = fmt.Errorf("Profile [%s] not found in [%s]", profile, file)
+	}
+	return
+}
+
+func s3Region() string {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); len(region) > 0 {
+			return region
+		}
+	}
+	return "us-east-1"
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and slashes if keepSlashes is set, as required to sign requests
+func s3Escape(str string, keepSlashes bool) string {
+	var escaped strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && keepSlashes) {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// s3ObjectURL returns the path-style HTTP URL of the object of an s3://bucket/key URL, using the endpoint set in the
+// AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL environment variables, or else the AWS endpoint of the region
+func s3ObjectURL(u *url.URL, region string) (*url.URL, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if len(bucket) == 0 || len(key) == 0 {
+		return nil, errors.New("S3 URLs must include a bucket and a key, ex: s3://bucket/public-resolvers.md")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if len(endpoint) == 0 {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if len(endpoint) == 0 {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	objURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid S3 endpoint [%s]: %v", endpoint, err)
+	}
+	objURL.Path = strings.TrimSuffix(objURL.Path, "/") + "/" + bucket + "/" + key
+	objURL.RawPath = s3Escape(objURL.Path, true)
+	objURL.RawQuery, objURL.Fragment = u.RawQuery, ""
+	return objURL, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signS3Request adds a signature version 4 of the request to header, including all the headers already set in it
+func signS3Request(method string, u *url.URL, header http.Header, creds s3Credentials, region string, now time.Time) {
+	if len(creds.accessKeyID) == 0 {
+		return
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	header.Set("X-Amz-Date", amzDate)
+	header.Set("X-Amz-Content-Sha256", s3EmptyPayloadHash)
+	if len(creds.sessionToken) > 0 {
+		header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+	values := map[string]string{"host": u.Host}
+	for name, value := range header {
+		values[strings.ToLower(name)] = strings.TrimSpace(strings.Join(value, ","))
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + values[name] + "\n")
+	}
+	query := u.Query()
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(params)
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{method, u.EscapedPath(), strings.Join(params, "&"), canonicalHeaders.String(), signedHeaders, s3EmptyPayloadHash}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+creds.secretAccessKey), amzDate[:8])
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+// fetchFromS3 sends a request for the object of an s3://bucket/key URL to S3-compatible object storage.
+// Signatures are fetched the same way, from the object whose key has the signature suffix.
+func (source *Source) fetchFromS3(ctx context.Context, xTransport *XTransport, transport http.RoundTripper, method string, u *url.URL, extraHeader http.Header, acceptedStatus []int) ([]byte, http.Header, error) {
+	region := s3Region()
+	objURL, err := s3ObjectURL(u, region)
+	if err != nil {
+		return nil, nil, err
+	}
+	creds, err := loadS3Credentials()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to load the S3 credentials of source [%s]: %v", source.name, err)
+	}
+	header := make(http.Header)
+	for name, values := range extraHeader {
+		header[name] = values
+	}
+	signS3Request(method, objURL, header, creds, region, time.Now())
+	bin, _, respHeader, _, err := xTransport.fetch(ctx, transport, method, objURL, header, acceptedStatus, nil, source.fetchTimeout())
+	return bin, respHeader, err
+}
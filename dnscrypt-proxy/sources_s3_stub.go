@@ -0,0 +1,17 @@
+// +build !s3sources
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// s3Supported is set in builds made with the s3sources tag
+const s3Supported = false
+
+func (source *Source) fetchFromS3(ctx context.Context, xTransport *XTransport, transport http.RoundTripper, method string, u *url.URL, extraHeader http.Header, acceptedStatus []int) ([]byte, http.Header, error) {
+	return nil, nil, errors.New("S3 URLs are not supported by this build, which must be made using the s3sources tag")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ScheduleDecision explains why PrefetchSources refreshed a source or skipped it
+type ScheduleDecision struct {
+	Source string
+	Run    bool      // the source was refreshed
+	Next   time.Time // when the source is due, if it is ever refreshed
+	Reason string    // ex: "not due: next at ...", "skipped: offline", "run: overdue since ..."
+}
+
+// ScheduleTracer receives the decisions made by PrefetchSources for a source, and must not block
+type ScheduleTracer func(decision ScheduleDecision)
+
+// SourcePrefetch tells what PrefetchSourcesDetailed did with a source
+type SourcePrefetch struct {
+	Source      string
+	NextRefresh time.Time // when the source is due, zero if it is never refreshed such as offline sources
+	Ran         bool      // the source was due, and a refresh was attempted
+	Err         error     // error of the refresh, if it failed
+}
+
+// nextDue returns when the source is due to be refreshed, at the end of the cooldown if its updates are suspended by the circuit breaker
+func (snapshot statusSnapshot) nextDue() time.Time {
+	due := snapshot.refresh
+	if due.Before(snapshot.suspendedUntil) {
+		due = snapshot.suspendedUntil
+	}
+	return due
+}
+
+// traceSchedule reports a decision to the schedule tracer of the source, if there is one
+func (source *Source) traceSchedule(run bool, format string, args ...interface{}) {
+	if source.options.ScheduleTracer == nil {
+		return
+	}
+	source.options.ScheduleTracer(ScheduleDecision{Source: source.name, Run: run, Next: source.snapshot().refresh, Reason: fmt.Sprintf(format, args...)})
+}
+
+// DailySchedule is a time of day at which a source is refreshed every day, see RefreshAt
+type DailySchedule struct {
+	Hour, Minute int
+	Location     *time.Location // time zone of Hour and Minute, local time if nil
+}
+
+// ParseDailySchedule decodes a time of day written as HH:MM, optionally followed by the name of a time zone, ex: "03:00 Europe/Paris"
+func ParseDailySchedule(spec string) (*DailySchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("Invalid refresh time: [%s], expected HH:MM optionally followed by a time zone", spec)
+	}
+	timeOfDay, err := time.Parse("15:04", fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid refresh time: [%s], expected HH:MM optionally followed by a time zone", spec)
+	}
+	schedule := &DailySchedule{Hour: timeOfDay.Hour(), Minute: timeOfDay.Minute()}
+	if len(fields) == 2 {
+		if schedule.Location, err = time.LoadLocation(fields[1]); err != nil {
+			return nil, fmt.Errorf("Invalid time zone in refresh time [%s]: %v", spec, err)
+		}
+	}
+	return schedule, nil
+}
+
+// Next returns the first time of the schedule after t. Days are counted in the time zone of the schedule, so that the
+// time of day stays the same across DST transitions. A time skipped by a transition is moved forward by the length of
+// the transition, and a time repeated by a transition is only used once.
+func (schedule *DailySchedule) Next(t time.Time) time.Time {
+	location := schedule.Location
+	if location == nil {
+		location = time.Local
+	}
+	local := t.In(location)
+	year, month, day := local.Date()
+	for days := 0; ; days++ {
+		next := time.Date(year, month, day+days, schedule.Hour, schedule.Minute, 0, 0, location)
+		skipped := (schedule.Hour*60 + schedule.Minute) - (next.Hour()*60 + next.Minute())
+		if skipped < -12*60 {
+			skipped += 24 * 60 // transition at midnight
+		}
+		if skipped > 0 {
+			next = next.Add(time.Duration(skipped) * time.Minute) // time.Date may return the time before the transition instead
+		}
+		if next.After(t) {
+			return next
+		}
+	}
+}
+
+func (schedule *DailySchedule) String() string {
+	if schedule.Location == nil {
+		return fmt.Sprintf("%02d:%02d", schedule.Hour, schedule.Minute)
+	}
+	return fmt.Sprintf("%02d:%02d %s", schedule.Hour, schedule.Minute, schedule.Location)
+}
+
+// scheduledDelay returns the delay from now until the source is due, for content last refreshed at refreshed:
+// until the next time of RefreshAt after refreshed if it is set, or else until refreshDelay after refreshed
+func (source *Source) scheduledDelay(refreshed, now time.Time) time.Duration {
+	if source.options.RefreshAt != nil {
+		return source.options.RefreshAt.Next(refreshed).Sub(now)
+	}
+	return source.refreshDelay() - now.Sub(refreshed)
+}
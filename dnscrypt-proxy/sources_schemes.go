@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+)
+
+// SignatureScheme verifies signatures made with another scheme than minisign, so that a source can be signed with both
+// while migrating from one to the other, and the minisign signatures dropped once all clients can verify the new ones
+type SignatureScheme struct {
+	Name   string // displayed in the logs
+	Suffix string // added to the URLs of the content to get its signature made with this scheme, ex: .newsig
+	Verify func(bin, sig []byte) error
+}
+
+// checkSchemeSignature verifies a signature with the SignatureSchemes of the source, in order, after minisign failed
+// with minisignErr. The signature is checked by each scheme, since cached signatures don't record the scheme they were made with.
+func (source *Source) checkSchemeSignature(bin, sig []byte, minisignErr error) error {
+	if len(source.options.SignatureSchemes) == 0 {
+		return minisignErr
+	}
+	tried := make([]string, 0, len(source.options.SignatureSchemes))
+	for _, scheme := range source.options.SignatureSchemes {
+		if err := scheme.Verify(bin, sig); err == nil {
+			dlog.Debugf("Source [%s] signature verified using scheme [%s]", source.name, scheme.Name)
+			return nil
+		}
+		tried = append(tried, scheme.Name)
+	}
+	return fmt.Errorf("%v - schemes tried: [minisign, %s]", minisignErr, strings.Join(tried, ", "))
+}
+
+// schemeSignature downloads the signatures of the content at srcURL made with the SignatureSchemes of the source, in order,
+// and returns the first one that verifies bin, or nil if none does. Signature bundles and Git URLs only have minisign signatures.
+func (source *Source) schemeSignature(ctx context.Context, xTransport *XTransport, srcURL *url.URL, bin []byte) ([]byte, *url.URL) {
+	if source.options.Bundle || isGitURL(srcURL) {
+		return nil, nil
+	}
+	for _, scheme := range source.options.SignatureSchemes {
+		sigURL := signatureURL(srcURL, scheme.Suffix, source.options.SignatureAfterQuery)
+		sig, err := source.fetchSignatureWithRetries(ctx, xTransport, sigURL)
+		if err != nil {
+			dlog.Debugf("Source [%s] failed to download the [%s] signature from URL [%s]: %v", source.name, scheme.Name, redactedURL(sigURL), err)
+			continue
+		}
+		if err = scheme.Verify(bin, sig); err != nil {
+			dlog.Debugf("Source [%s] failed [%s] signature check using URL [%s]: %v", source.name, scheme.Name, redactedURL(sigURL), err)
+			continue
+		}
+		dlog.Noticef("Source [%s] signature from URL [%s] verified using scheme [%s]", source.name, redactedURL(sigURL), scheme.Name)
+		return sig, sigURL
+	}
+	return nil, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// seedContent returns the bundled copy of the source and its signature, from SeedFile or Seed
+func (source *Source) seedContent() (bin, sig []byte, err error) {
+	if len(source.options.SeedFile) == 0 {
+		return source.options.Seed, source.options.SeedSignature, nil
+	}
+	if bin, err = ioutil.ReadFile(source.options.SeedFile); err != nil {
+		return
+	}
+	sig, err = ioutil.ReadFile(source.options.SeedFile + source.signatureSuffix())
+	return
+}
+
+// seedCache writes the bundled copy of the source to the cache if there is no cached copy yet, once it has been verified like a download.
+// The cached copy is dated so that it has already expired, and the source is refreshed by the next PrefetchSources.
+// The bundled copy is ignored if it can't be verified.
+func (source *Source) seedCache(ctx context.Context, now time.Time) bool {
+	if len(source.options.SeedFile) == 0 && len(source.options.Seed) == 0 {
+		return false
+	}
+	store := source.cacheStore()
+	if _, err := store.Stat(source.cacheFile); !os.IsNotExist(err) {
+		return false
+	}
+	bin, sig, err := source.seedContent()
+	if err == nil {
+		err = source.checkSignature(bin, sig)
+	}
+	if err == nil {
+		_, err = source.signedTimestamp(sig)
+	}
+	if err == nil {
+		err = source.checkPin(bin)
+	}
+	var in []byte
+	if err == nil {
+		in, err = source.transformContent(bin)
+	}
+	if err == nil && source.options.OnParseFailure == ParseFailureRefresh {
+		err = source.checkParsable(in)
+	}
+	if err != nil {
+		dlog.Warnf("Source [%s] bundled copy ignored: %v", source.name, err)
+		return false
+	}
+	if err = source.writeCache(ctx, store, bin, sig); err == nil {
+		err = store.Touch(source.cacheFile, now.Add(-source.cacheTTL))
+	}
+	if err != nil {
+		dlog.Warnf("Source [%s] cache file [%s] can't be seeded with the bundled copy: %v", source.name, source.cacheFile, err)
+		return false
+	}
+	source.setContent(bin, in)
+	dlog.Noticef("Source [%s] cache file [%s] seeded with the bundled copy", source.name, source.cacheFile)
+	return true
+}
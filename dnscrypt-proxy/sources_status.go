@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// SourceStatus describes the state of a source, for monitoring
+type SourceStatus struct {
+	Name        string     `json:"name"`
+	URLs        []string   `json:"urls"`
+	LastRefresh *time.Time `json:"last_refresh,omitempty"` // last time the source was loaded or checked for updates
+	NextRefresh *time.Time `json:"next_refresh,omitempty"`
+	AgeSeconds  int64      `json:"age_seconds"` // time since the current content was downloaded
+	LastError   string     `json:"last_error,omitempty"`
+	ParseError  string     `json:"parse_error,omitempty"` // error of the last Parse, even if it kept the servers previously parsed
+	Servers     int        `json:"servers"`               // number of servers returned by the last successful Parse
+	KeyIDs      []string   `json:"key_ids"`
+	Origin      string     `json:"origin,omitempty"` // URL the current content was downloaded from, or "cache"
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// statusSnapshot is the part of the state of a source that changes during refreshes, copied once they are completed,
+// so that Status, MirrorStats and the scheduling of refreshes don't wait for a refresh in progress, nor race with it
+type statusSnapshot struct {
+	urls              []string
+	lastRefresh       time.Time
+	refresh           time.Time
+	lastError         string
+	keyIDs            []string
+	origin            string    // empty if the source has no content
+	lastSuccessfulURL string    // empty if the content was loaded from the cache
+	verifyFailures    int       // consecutive failed verifications
+	suspendedUntil    time.Time // end of the suspension of updates by the circuit breaker, zero if it isn't tripped
+}
+
+// snapshotStatus copies the state of the source reported by Status, and must be called with refreshLock held
+func (source *Source) snapshotStatus() {
+	snapshot := statusSnapshot{
+		urls:        make([]string, 0, len(source.urls)),
+		lastRefresh: source.lastRefresh,
+		refresh:     source.refresh,
+		lastError:   source.lastError,
+		keyIDs:      make([]string, 0, len(source.minisignKeys)),
+	}
+	for _, srcURL := range source.urls {
+		snapshot.urls = append(snapshot.urls, redactedURL(srcURL))
+	}
+	for _, key := range source.minisignKeys {
+		snapshot.keyIDs = append(snapshot.keyIDs, key.id)
+	}
+	if len(source.in) > 0 {
+		if snapshot.origin = source.lastSuccessfulURL; snapshot.origin == "" {
+			snapshot.origin = "cache"
+		}
+	}
+	snapshot.lastSuccessfulURL, snapshot.verifyFailures = source.lastSuccessfulURL, source.verifyFailures
+	if source.breakerTripped() {
+		snapshot.suspendedUntil = source.breakerUntil
+	}
+	source.statsLock.Lock()
+	source.status = snapshot
+	source.statsLock.Unlock()
+}
+
+// snapshot returns the state of the source copied by the last snapshotStatus
+func (source *Source) snapshot() statusSnapshot {
+	source.statsLock.Lock()
+	defer source.statsLock.Unlock()
+	return source.status
+}
+
+// Status returns the state of the source, as of the end of the last refresh if one is in progress
+func (source *Source) Status() SourceStatus {
+	source.statsLock.Lock()
+	snapshot := source.status
+	status := SourceStatus{
+		Name:        source.name,
+		URLs:        append(make([]string, 0, len(snapshot.urls)), snapshot.urls...),
+		LastRefresh: optionalTime(snapshot.lastRefresh),
+		NextRefresh: optionalTime(snapshot.refresh),
+		LastError:   snapshot.lastError,
+		ParseError:  source.parseError,
+		KeyIDs:      append(make([]string, 0, len(snapshot.keyIDs)), snapshot.keyIDs...),
+		Origin:      snapshot.origin,
+	}
+	if status.Servers = len(source.lastGood); source.options.OnParseFailure != ParseFailureKeepLastGood {
+		status.Servers = len(source.serverNames)
+	}
+	source.statsLock.Unlock()
+	if len(status.Origin) > 0 {
+		if modTime, err := source.cacheStore().Stat(source.cacheFile); err == nil {
+			status.AgeSeconds = int64(timeNow().Sub(modTime) / time.Second)
+		}
+	}
+	return status
+}
+
+// SourcesStatusJSON serializes the state of the sources, for example for an administration endpoint
+func SourcesStatusJSON(sources []*Source) ([]byte, error) {
+	statuses := make([]SourceStatus, 0, len(sources))
+	for _, source := range sources {
+		statuses = append(statuses, source.Status())
+	}
+	return json.Marshal(statuses)
+}
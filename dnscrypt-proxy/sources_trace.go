@@ -0,0 +1,25 @@
+package main
+
+import "net/url"
+
+// SourceTracer starts a span for an operation of a source, such as "source.fetch", "source.verify" or "source.parse",
+// and returns the function ending it with the error of the operation, if any.
+// Attributes include "source", the name of the source, and "url" for downloads, without its user name and password.
+type SourceTracer func(name string, attributes map[string]string) (end func(err error))
+
+func noopSpanEnd(error) {}
+
+// startSpan starts a span using the tracer of the source, if there is one
+func (source *Source) startSpan(name string, u *url.URL) func(error) {
+	if source.options.Tracer == nil {
+		return noopSpanEnd
+	}
+	attributes := map[string]string{"source": source.name}
+	if u != nil {
+		attributes["url"] = redactedURL(u)
+	}
+	if end := source.options.Tracer(name, attributes); end != nil {
+		return end
+	}
+	return noopSpanEnd
+}
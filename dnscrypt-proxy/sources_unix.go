@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Sources can be downloaded over HTTP from a Unix domain socket, using URLs such as:
+//
+//	unix:/run/sources.sock:/public-resolvers.md
+//
+// The socket path ends at the first ":", and is followed by the path (and query string) of the HTTP request.
+// The signature is downloaded from the same socket, as unix:/run/sources.sock:/public-resolvers.md.minisig
+const unixSocketScheme = "unix"
+
+func splitUnixSocketURL(u *url.URL) (socketPath string, reqURL *url.URL, err error) {
+	parts := strings.SplitN(u.Path, ":", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || !strings.HasPrefix(parts[1], "/") {
+		return "", nil, errors.New("Invalid Unix socket URL, expected unix:<socket path>:<request path>")
+	}
+	reqURL = &url.URL{Scheme: "http", Host: "localhost", Path: parts[1], RawQuery: u.RawQuery}
+	return parts[0], reqURL, nil
+}
+
+// fetchFromUnixSocket sends a request to a Unix socket URL, like fetchURL does for other URLs: with the timeout and the bandwidth
+// limits of the source, checking the length of the response, and decoding it
+func (source *Source) fetchFromUnixSocket(ctx context.Context, xTransport *XTransport, method string, u *url.URL, header http.Header, acceptedStatus []int) ([]byte, http.Header, error) {
+	socketPath, reqURL, err := splitUnixSocketURL(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	// the socket is dialed instead of the host name of reqURL, so the host name must not be resolved
+	bin, _, respHeader, _, err := xTransport.fetch(withOwnResolver(ctx), source.throttle(transport), method, reqURL, acceptEncodings(header), acceptedStatus, nil, source.fetchTimeout())
+	if err != nil {
+		return nil, nil, truncatedDownload(err, u)
+	}
+	bin, err = decodeContent(bin, respHeader)
+	return bin, respHeader, err
+}
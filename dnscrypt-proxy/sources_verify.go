@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// verifyCacheKey identifies content along with its signature; both are needed, since the same content can come with an invalid signature
+type verifyCacheKey [2 * sha256.Size]byte
+
+func newVerifyCacheKey(bin, sig []byte) (key verifyCacheKey) {
+	binHash, sigHash := sha256.Sum256(bin), sha256.Sum256(sig)
+	copy(key[:sha256.Size], binHash[:])
+	copy(key[sha256.Size:], sigHash[:])
+	return
+}
+
+// newVerifyCache returns a cache of the content and signatures successfully verified with the keys of a source,
+// or nil if size is not positive
+func newVerifyCache(size int) (*lru.Cache, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+	return lru.New(size)
+}
+
+// alreadyVerified tells if the signature of the content has already been successfully verified
+func (source *Source) alreadyVerified(key verifyCacheKey) bool {
+	if source.verifyCache == nil {
+		return false
+	}
+	_, ok := source.verifyCache.Get(key)
+	return ok
+}
+
+func (source *Source) addVerified(key verifyCacheKey) {
+	if source.verifyCache != nil {
+		source.verifyCache.Add(key, struct{}{})
+	}
+}
+
+// setKeys replaces the keys of the source, and forgets the signatures verified with the previous ones if they changed,
+// so that content signed with a key that was removed is no longer accepted
+func (source *Source) setKeys(keys []sourceKey) {
+	changed := len(keys) != len(source.minisignKeys)
+	for i := 0; !changed && i < len(keys); i++ {
+		changed = keys[i].key != source.minisignKeys[i].key
+	}
+	source.minisignKeys = keys
+	if changed && source.verifyCache != nil {
+		source.verifyCache.Purge()
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlServer is an entry of a YAML source, which is a list of such entries:
+//
+//   - name: example-server
+//     stamp: sdns://...
+//     description: An example server
+//     tags: [dnssec, no-log]
+type yamlServer struct {
+	Name        string   `yaml:"name"`
+	Stamp       string   `yaml:"stamp"`
+	Description string   `yaml:"description,omitempty"`
+	Tags        []string `yaml:"tags,omitempty,flow"`
+}
+
+func (source *Source) scanYAML(bin []byte, prefix string) ([]sourceEntry, error) {
+	var servers []yamlServer
+	decoder := yaml.NewDecoder(bytes.NewReader(bin))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&servers); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("Invalid format for source at [%v]", redactedURLs(source.urls))
+		}
+		return nil, fmt.Errorf("Invalid YAML in source [%s]: %v", source.name, err)
+	}
+	entries := make([]sourceEntry, 0, len(servers))
+	for i, server := range servers {
+		if len(server.Name) == 0 {
+			return entries, fmt.Errorf("Entry #%d of source [%s] has no name", i, source.name)
+		}
+		entries = append(entries, sourceEntry{
+			name: prefix + server.Name, stampStr: server.Stamp, description: server.Description, tags: server.Tags,
+		})
+	}
+	return entries, nil
+}
+
+// MarshalYAMLSource returns a YAML source listing the servers
+func MarshalYAMLSource(registeredServers []RegisteredServer) ([]byte, error) {
+	servers := make([]yamlServer, 0, len(registeredServers))
+	for _, registeredServer := range registeredServers {
+		servers = append(servers, yamlServer{
+			Name: registeredServer.name, Stamp: registeredServer.stamp.String(),
+			Description: registeredServer.description, Tags: registeredServer.tags,
+		})
+	}
+	return yaml.Marshal(servers)
+}
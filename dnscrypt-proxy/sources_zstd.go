@@ -0,0 +1,21 @@
+// +build zstd
+
+package main
+
+import (
+	"bytes"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdSupported is set in builds made with the zstd tag
+const zstdSupported = true
+
+func decompressZstd(bin []byte) ([]byte, error) {
+	decoder, err := zstd.NewReader(bytes.NewReader(bin), zstd.WithDecoderMaxMemory(MaxHTTPBodyLength), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	return readDecompressed(decoder)
+}
@@ -0,0 +1,12 @@
+// +build !zstd
+
+package main
+
+import "errors"
+
+// zstdSupported is set in builds made with the zstd tag
+const zstdSupported = false
+
+func decompressZstd([]byte) ([]byte, error) {
+	return nil, errors.New("Zstandard support requires a build with the zstd tag")
+}
@@ -0,0 +1,97 @@
+// +build zstd
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/powerman/check"
+)
+
+// compressZstd streams bin with a small window and without the content size in the header, so that content is only
+// rejected by its decompressed size
+func compressZstd(t *testing.T, bin []byte) []byte {
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf, zstd.WithWindowSize(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(bin); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func compressGzip(t *testing.T, bin []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(bin); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestZstdContent(t *testing.T) {
+	teardown, d := setupSourceTest(t)
+	defer teardown()
+	c := check.T(t)
+	name := d.sources[0]
+	content := readFixture(t, filepath.Join("sources", name))
+	bin, err := decodeContent(compressZstd(t, content), http.Header{"Content-Encoding": {"zstd"}})
+	c.Nil(err)
+	c.DeepEqual(bin, content, "Content changed by a zstd round trip")
+
+	var encodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Accept-Encoding"))
+		bin := readFixture(t, filepath.Join("sources", strings.TrimPrefix(r.URL.Path, "/")))
+		w.Header().Set("Content-Encoding", "zstd")
+		w.Write(compressZstd(t, bin))
+	}))
+	defer server.Close()
+	source, err := NewSource("zstd", d.xTransport, []string{server.URL + "/" + name}, []string{d.keyStr}, "zstd.md", "v2", DefaultPrefetchDelay*3,
+		SourceOptions{CacheStore: NewMemoryCacheStore()})
+	c.Nil(err, "Unexpected error")
+	c.DeepEqual(source.in, content, "Compressed content not decompressed")
+	c.DeepEqual(encodings, []string{contentEncodings, contentEncodings}, "zstd not requested")
+}
+
+func TestZstdBomb(t *testing.T) {
+	teardown, d := setupSourceTest(t)
+	defer teardown()
+	c := check.T(t)
+	bomb := make([]byte, MaxHTTPBodyLength+1)
+	for _, encoding := range []string{"zstd", "gzip"} {
+		var bin []byte
+		if encoding == "zstd" {
+			bin = compressZstd(t, bomb)
+		} else {
+			bin = compressGzip(t, bomb)
+		}
+		c.True(len(bin) < MaxHTTPBodyLength/100, "%s content not compressed enough to be a bomb", encoding)
+		_, err := decodeContent(bin, http.Header{"Content-Encoding": {encoding}})
+		c.Match(err, "Decompressed content is larger than", "Oversized %s content decompressed", encoding)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", encoding)
+			w.Write(bin)
+		}))
+		_, err = NewSource("bomb", d.xTransport, []string{server.URL + "/relays.md"}, []string{d.keyStr}, "bomb.md", "v2", DefaultPrefetchDelay*3,
+			SourceOptions{CacheStore: NewMemoryCacheStore()})
+		c.Match(err, "Decompressed content is larger than", "Oversized %s content downloaded", encoding)
+		server.Close()
+	}
+}
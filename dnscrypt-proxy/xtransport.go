@@ -5,9 +5,11 @@
 	"context"
 	"crypto/sha512"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -33,8 +35,50 @@
 	SystemResolverIPTTL     = 24 * time.Hour
 	MinResolverIPTTL        = 12 * time.Hour
 	ExpiredCachedIPGraceTTL = 15 * time.Minute
+	MaxDrainedBodyLength    = 4096 // bytes of a rejected response read so that its connection can be reused
 )
 
+// HTTPStatusError is returned when a server responds with an unsuccessful status code
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (err *HTTPStatusError) Error() string {
+	return err.Status
+}
+
+// shortBodyError is returned when a response body ends before its Content-Length. Its message is the one of the read error.
+type shortBodyError struct {
+	err       error
+	received  int
+	announced int64
+}
+
+func (err *shortBodyError) Error() string {
+	return err.err.Error()
+}
+
+func (err *shortBodyError) Unwrap() error {
+	return err.err
+}
+
+// checkStatus returns an HTTPStatusError if the status code of a response is not 2xx, or not one of accepted if it is not empty
+func checkStatus(resp *http.Response, accepted []int) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if len(accepted) == 0 {
+		return nil
+	}
+	for _, statusCode := range accepted {
+		if resp.StatusCode == statusCode {
+			return nil
+		}
+	}
+	return &HTTPStatusError{StatusCode: resp.StatusCode, Status: fmt.Sprintf("Unexpected status %s, accepted status codes: %v", resp.Status, accepted)}
+}
+
 type CachedIPItem struct {
 	ip         net.IP
 	expiration *time.Time
@@ -121,6 +165,152 @@ func (xTransport *XTransport) rebuildTransport() {
 	if xTransport.transport != nil {
 		(*xTransport.transport).CloseIdleConnections()
 	}
+	xTransport.transport = xTransport.newTransport(xTransport.tlsClientConfig(), nil)
+}
+
+// HostResolver returns the address to dial for a host name, instead of the cache and the resolvers of the XTransport
+type HostResolver func(ctx context.Context, host string) (net.IP, error)
+
+// ownResolverKey marks the context of requests sent with a transport that has a HostResolver, see withOwnResolver
+type ownResolverKey struct{}
+
+// withOwnResolver returns a context for requests sent with a transport that has a HostResolver, so that fetch doesn't
+// resolve their host names with the cache and the resolvers of the XTransport beforehand. If a proxy is configured, the
+// HostResolver isn't used either: host names are then left to the proxy, so that they are never resolved locally.
+func withOwnResolver(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ownResolverKey{}, true)
+}
+
+// headersOnlyKey marks the context of requests whose response body is not read, see withHeadersOnly
+type headersOnlyKey struct{}
+
+// withHeadersOnly returns a context for requests only sent to check that a URL is reachable: fetch then closes the body
+// of their responses without reading it, and returns no content.
+func withHeadersOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, headersOnlyKey{}, true)
+}
+
+// transportWithTLS returns a new transport with the same settings as the main one, except for the given TLS settings,
+// resolving host names with resolver if it is not nil
+func (xTransport *XTransport) transportWithTLS(minVersion uint16, rootCAs *x509.CertPool, resolver HostResolver) *http.Transport {
+	tlsClientConfig := xTransport.tlsClientConfig()
+	if tlsClientConfig == nil {
+		tlsClientConfig = &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(10)}
+	}
+	if minVersion != 0 {
+		tlsClientConfig.MinVersion = minVersion
+	}
+	if rootCAs != nil {
+		tlsClientConfig.RootCAs = rootCAs
+	}
+	return xTransport.newTransport(tlsClientConfig, resolver)
+}
+
+// disableHTTP2 makes a transport returned by newTransport only use HTTP/1.1
+func disableHTTP2(transport *http.Transport) {
+	transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	if transport.TLSClientConfig == nil {
+		return
+	}
+	var nextProtos []string
+	for _, proto := range transport.TLSClientConfig.NextProtos {
+		if proto != http2.NextProtoTLS {
+			nextProtos = append(nextProtos, proto)
+		}
+	}
+	transport.TLSClientConfig.NextProtos = nextProtos
+}
+
+// h2cTransport returns a transport sending HTTP/2 requests without TLS to servers known to support it,
+// dialing connections like base, which must have been returned by newTransport
+func h2cTransport(base *http.Transport) http.RoundTripper {
+	rt := &h2cRoundTripper{base: base, conns: make(map[string][]*http2.ClientConn)}
+	rt.h2 = &http2.Transport{AllowHTTP: true, ConnPool: rt}
+	return rt
+}
+
+// h2cRoundTripper is the connection pool of an http2.Transport, dialing new connections with the context of the request
+// that needs them, so that a HostResolver resolving their host name honors its deadline and its cancellation, which the
+// DialTLS function of http2.Transport can't
+type h2cRoundTripper struct {
+	base  *http.Transport
+	h2    *http2.Transport
+	lock  sync.Mutex
+	conns map[string][]*http2.ClientConn // by address
+}
+
+func (rt *h2cRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return rt.h2.RoundTrip(req)
+}
+
+func (rt *h2cRoundTripper) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	rt.lock.Lock()
+	for _, cc := range rt.conns[addr] {
+		if cc.CanTakeNewRequest() {
+			rt.lock.Unlock()
+			return cc, nil
+		}
+	}
+	rt.lock.Unlock()
+	conn, err := rt.base.DialContext(req.Context(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := rt.h2.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rt.lock.Lock()
+	rt.conns[addr] = append(rt.conns[addr], cc)
+	rt.lock.Unlock()
+	return cc, nil
+}
+
+func (rt *h2cRoundTripper) MarkDead(dead *http2.ClientConn) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	for addr, conns := range rt.conns {
+		for i, cc := range conns {
+			if cc == dead {
+				rt.conns[addr] = append(conns[:i:i], conns[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// CloseIdleConnections closes all the connections of the pool, once the requests they are sending are completed
+func (rt *h2cRoundTripper) CloseIdleConnections() {
+	rt.lock.Lock()
+	conns := rt.conns
+	rt.conns = make(map[string][]*http2.ClientConn)
+	rt.lock.Unlock()
+	for _, addrConns := range conns {
+		for _, cc := range addrConns {
+			go cc.Shutdown(context.Background())
+		}
+	}
+}
+
+func (xTransport *XTransport) tlsClientConfig() *tls.Config {
+	if !xTransport.tlsDisableSessionTickets && xTransport.tlsCipherSuite == nil {
+		return nil
+	}
+	tlsClientConfig := tls.Config{
+		SessionTicketsDisabled: xTransport.tlsDisableSessionTickets,
+	}
+	if !xTransport.tlsDisableSessionTickets {
+		tlsClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(10)
+	}
+	if xTransport.tlsCipherSuite != nil {
+		tlsClientConfig.PreferServerCipherSuites = false
+		tlsClientConfig.CipherSuites = xTransport.tlsCipherSuite
+	}
+	return &tlsClientConfig
+}
+
+func (xTransport *XTransport) newTransport(tlsClientConfig *tls.Config, resolver HostResolver) *http.Transport {
 	timeout := xTransport.timeout
 	transport := &http.Transport{
 		DisableKeepAlives:      false,
@@ -133,9 +323,19 @@ func (xTransport *XTransport) rebuildTransport() {
 		DialContext: func(ctx context.Context, network, addrStr string) (net.Conn, error) {
 			host, port := ExtractHostAndPort(addrStr, stamps.DefaultPort)
 			ipOnly := host
-			// resolveAndUpdateCache() is always called in `Fetch()` before the `Dial()`
-			// method is used, so that a cached entry must be present at this point.
-			cachedIP, _ := xTransport.loadCachedIP(host)
+			var cachedIP net.IP
+			// names are left to proxies, which resolve them themselves
+			if resolver != nil && ParseIP(host) == nil && xTransport.proxyDialer == nil && xTransport.httpProxyFunction == nil {
+				ip, err := resolver(ctx, host)
+				if err != nil {
+					return nil, err
+				}
+				cachedIP = ip
+			} else {
+				// resolveAndUpdateCache() is always called in `Fetch()` before the `Dial()`
+				// method is used, so that a cached entry must be present at this point.
+				cachedIP, _ = xTransport.loadCachedIP(host)
+			}
 			if cachedIP != nil {
 				if ipv4 := cachedIP.To4(); ipv4 != nil {
 					ipOnly = ipv4.String()
@@ -156,21 +356,11 @@ func (xTransport *XTransport) rebuildTransport() {
 	if xTransport.httpProxyFunction != nil {
 		transport.Proxy = xTransport.httpProxyFunction
 	}
-	if xTransport.tlsDisableSessionTickets || xTransport.tlsCipherSuite != nil {
-		tlsClientConfig := tls.Config{
-			SessionTicketsDisabled: xTransport.tlsDisableSessionTickets,
-		}
-		if !xTransport.tlsDisableSessionTickets {
-			tlsClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(10)
-		}
-		if xTransport.tlsCipherSuite != nil {
-			tlsClientConfig.PreferServerCipherSuites = false
-			tlsClientConfig.CipherSuites = xTransport.tlsCipherSuite
-		}
-		transport.TLSClientConfig = &tlsClientConfig
+	if tlsClientConfig != nil {
+		transport.TLSClientConfig = tlsClientConfig
 	}
 	http2.ConfigureTransport(transport)
-	xTransport.transport = transport
+	return transport
 }
 
 func (xTransport *XTransport) resolveUsingSystem(host string) (ip net.IP, ttl time.Duration, err error) {
@@ -318,17 +508,59 @@ func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
 }
 
 func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string, contentType string, body *[]byte, timeout time.Duration) ([]byte, *tls.ConnectionState, time.Duration, error) {
-	if timeout <= 0 {
-		timeout = xTransport.timeout
-	}
-	client := http.Client{Transport: xTransport.transport, Timeout: timeout}
-	header := map[string][]string{"User-Agent": {"dnscrypt-proxy"}}
+	header := http.Header{}
 	if len(accept) > 0 {
 		header["Accept"] = []string{accept}
 	}
 	if len(contentType) > 0 {
 		header["Content-Type"] = []string{contentType}
 	}
+	bin, tls, _, rtt, err := xTransport.fetch(context.Background(), xTransport.transport, method, url, header, nil, body, FetchTimeout{Base: timeout})
+	return bin, tls, rtt, err
+}
+
+// FetchTimeout is the time allowed for a request and the download of its response
+type FetchTimeout struct {
+	Base time.Duration // time allowed for small responses, and for responses without a Content-Length, the timeout of the XTransport if 0
+	// expected download rate in bytes per second: if set, the time needed to download the Content-Length of responses at
+	// that rate is added to Base
+	Throughput int64
+}
+
+// forLength returns the time allowed for a response of the given length
+func (timeout FetchTimeout) forLength(length int64) time.Duration {
+	if timeout.Throughput <= 0 || length <= 0 {
+		return timeout.Base
+	}
+	if length > MaxHTTPBodyLength {
+		length = MaxHTTPBodyLength
+	}
+	return timeout.Base + time.Duration(length)*time.Second/time.Duration(timeout.Throughput)
+}
+
+// fetch sends a request using the given transport, with extraHeader added to the default headers.
+// Responses whose status code is not one of acceptedStatus, or not 2xx if it is empty, are rejected.
+func (xTransport *XTransport) fetch(ctx context.Context, transport http.RoundTripper, method string, url *url.URL, extraHeader http.Header, acceptedStatus []int, body *[]byte, timeout FetchTimeout) ([]byte, *tls.ConnectionState, http.Header, time.Duration, error) {
+	if timeout.Base <= 0 {
+		timeout.Base = xTransport.timeout
+	}
+	client := http.Client{Transport: transport}
+	var deadline *time.Timer
+	parentCtx := ctx
+	if timeout.Throughput > 0 {
+		// the deadline is set once the Content-Length is known, which the Timeout of the client doesn't allow
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		deadline = time.AfterFunc(timeout.Base, cancel)
+		defer deadline.Stop()
+	} else {
+		client.Timeout = timeout.Base
+	}
+	header := map[string][]string{"User-Agent": {"dnscrypt-proxy"}}
+	for name, values := range extraHeader {
+		header[name] = values
+	}
 	if body != nil {
 		h := sha512.Sum512(*body)
 		qs := url.Query()
@@ -339,11 +571,13 @@ func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string,
 	}
 	host, _ := ExtractHostAndPort(url.Host, 0)
 	if xTransport.proxyDialer == nil && strings.HasSuffix(host, ".onion") {
-		return nil, nil, 0, errors.New("Onion service is not reachable without Tor")
+		return nil, nil, nil, 0, errors.New("Onion service is not reachable without Tor")
 	}
-	if err := xTransport.resolveAndUpdateCache(host); err != nil {
-		dlog.Errorf("Unable to resolve [%v] - Make sure that the system resolver works, or that `fallback_resolver` has been set to a resolver that can be reached", host)
-		return nil, nil, 0, err
+	if ctx.Value(ownResolverKey{}) == nil {
+		if err := xTransport.resolveAndUpdateCache(host); err != nil {
+			dlog.Errorf("Unable to resolve [%v] - Make sure that the system resolver works, or that `fallback_resolver` has been set to a resolver that can be reached", host)
+			return nil, nil, nil, 0, err
+		}
 	}
 	req := &http.Request{
 		Method: method,
@@ -351,6 +585,7 @@ func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string,
 		Header: header,
 		Close:  false,
 	}
+	req = req.WithContext(ctx)
 	if body != nil {
 		req.ContentLength = int64(len(*body))
 		req.Body = ioutil.NopCloser(bytes.NewReader(*body))
@@ -361,28 +596,57 @@ func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string,
 	if err == nil {
 		if resp == nil {
 			err = errors.New("Webserver returned an error")
-		} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
-			err = errors.New(resp.Status)
+		} else {
+			err = checkStatus(resp, acceptedStatus)
 		}
 	} else {
-		(*xTransport.transport).CloseIdleConnections()
+		if deadline != nil && ctx.Err() != nil && parentCtx.Err() == nil {
+			err = fmt.Errorf("No response from [%s] within %v", req.URL, timeout.Base)
+		}
+		if closer, ok := transport.(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
+		}
 	}
 	if err != nil {
+		if resp != nil { // rejected, drained so that its connection can be reused unless it is large, and closed so that it is released
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, MaxDrainedBodyLength))
+			resp.Body.Close()
+		}
 		dlog.Debugf("[%s]: [%s]", req.URL, err)
 		if xTransport.tlsCipherSuite != nil && strings.Contains(err.Error(), "handshake failure") {
 			dlog.Warnf("TLS handshake failure - Try changing or deleting the tls_cipher_suite value in the configuration file")
 			xTransport.tlsCipherSuite = nil
 			xTransport.rebuildTransport()
 		}
-		return nil, nil, 0, err
+		return nil, nil, nil, 0, err
 	}
+	defer resp.Body.Close()
 	tls := resp.TLS
+	if ctx.Value(headersOnlyKey{}) != nil {
+		return nil, tls, resp.Header, rtt, nil
+	}
+	if deadline != nil && resp.ContentLength > 0 {
+		allowed := timeout.forLength(resp.ContentLength)
+		dlog.Debugf("[%s]: %d bytes to download in %v", req.URL, resp.ContentLength, allowed)
+		deadline.Reset(allowed - time.Since(start))
+	}
+	if resp.ContentLength > MaxHTTPBodyLength {
+		return nil, tls, nil, 0, fmt.Errorf("Response from [%s] announces %d bytes, more than the limit of %d bytes", req.URL, resp.ContentLength, MaxHTTPBodyLength)
+	}
 	bin, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxHTTPBodyLength))
+	if err != nil && deadline != nil && ctx.Err() != nil && parentCtx.Err() == nil {
+		return nil, tls, nil, 0, fmt.Errorf("Download of [%s] not completed within %v", req.URL, timeout.forLength(resp.ContentLength))
+	}
+	if int64(len(bin)) < resp.ContentLength { // compared explicitly, since the body may end early without an error
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, tls, nil, 0, &shortBodyError{err: err, received: len(bin), announced: resp.ContentLength}
+	}
 	if err != nil {
-		return nil, tls, 0, err
+		return nil, tls, nil, 0, err
 	}
-	resp.Body.Close()
-	return bin, tls, rtt, err
+	return bin, tls, resp.Header, rtt, nil
 }
 
 func (xTransport *XTransport) Get(url *url.URL, accept string, timeout time.Duration) ([]byte, *tls.ConnectionState, time.Duration, error) {